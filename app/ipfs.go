@@ -16,10 +16,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
+// stdin is shared by everything reading input so nothing buffered is lost
+// between commands.
+var stdin = bufio.NewReader(os.Stdin)
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Not enough arguments.")
@@ -52,9 +57,8 @@ func main() {
 
 func start(client serverpb.ClientClient, ctx context.Context) {
 	for {
-		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("ipfs> ")
-		input, err := reader.ReadString('\n')
+		input, err := stdin.ReadString('\n')
 		if err != nil {
 			fmt.Printf("%+v\n", err)
 			os.Exit(0)
@@ -74,6 +78,10 @@ func start(client serverpb.ClientClient, ctx context.Context) {
 			publish(cmd, client, ctx)
 		case "subscribe":
 			subscribe(cmd, client, ctx)
+		case "stats":
+			stats(cmd, client, ctx)
+		case "providers":
+			providers(cmd, client, ctx)
 		case "help":
 			fmt.Printf("\n 🚀  List of options: \n\n")
 			fmt.Println("	get <document_access_id>		   Fetch a document")
@@ -82,10 +90,16 @@ func start(client serverpb.ClientClient, ctx context.Context) {
 			fmt.Println("	add -c <documents>		  	   Create a parent to a list of existing documents")
 			fmt.Println("	peers list				   List this node's peers")
 			fmt.Println("	peers add <node_address>	  	   Add a peer to this node")
+			fmt.Println("	peers blocklist			   List blocked and banned peers")
+			fmt.Println("	peers block <node_id|address>		   Block a peer and disconnect it")
+			fmt.Println("	peers unblock <node_id|address>	   Unblock a peer or lift its ban")
 			fmt.Println("	reference get <reference_access_id>        Fetch what this reference points to")
 			fmt.Println("	reference add <record> <path/to/priv_key>  Add or update a reference")
 			fmt.Println("	publish <message> <path/to/priv_key>	   Publish a message on a channel")
+			fmt.Println("	publish -f <path/to/file> <path/to/priv_key> [key=value ...]  Publish a file with headers")
 			fmt.Println("	subscribe <reference_id>		   Listen for messages on a channel")
+			fmt.Println("	stats					   Show this node's routing table statistics")
+			fmt.Println("	providers <id>				   List the nodes that hold a document or reference")
 			fmt.Printf("	quit					   Exit the program\n\n")
 		case "quit":
 			fmt.Println("Exiting program... Goodbye. 🌙")
@@ -206,6 +220,15 @@ func peers(cmd []string, client serverpb.ClientClient, ctx context.Context) {
 			fmt.Println(err)
 		} else {
 			fmt.Println(resp.GetPeers())
+			fmt.Println("Connected peers:")
+			for _, st := range resp.GetStats() {
+				status := "healthy"
+				if st.Failing {
+					status = "failing"
+				}
+				fmt.Printf("  %s: %s, %.1fms, %d ok, %d failed, penalty %d, score %d\n",
+					st.Id, status, st.LatencyMs, st.Successes, st.Failures, st.Penalty, st.Score)
+			}
 		}
 	} else if cmd[1] == "add" && len(cmd) == 3 {
 		args := &serverpb.AddPeerRequest{
@@ -219,6 +242,40 @@ func peers(cmd []string, client serverpb.ClientClient, ctx context.Context) {
 		}
 	} else if cmd[1] == "add" && len(cmd) != 3 {
 		fmt.Println("Please specify a peer ID.")
+	} else if cmd[1] == "blocklist" {
+		resp, err := client.GetBlocklist(ctx, &serverpb.GetBlocklistRequest{})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Blocked:")
+		for _, e := range resp.GetEntries() {
+			fmt.Printf("  %s%s  added %s\n", e.Id, e.Addr, time.Unix(e.Added, 0).Format(time.RFC3339))
+		}
+		fmt.Println("Banned:")
+		for _, b := range resp.GetBans() {
+			fmt.Printf("  %s  until %s\n", b.Id, time.Unix(b.Until, 0).Format(time.RFC3339))
+		}
+	} else if (cmd[1] == "block" || cmd[1] == "unblock") && len(cmd) == 3 {
+		// Node IDs are base64 encoded SHA1 hashes, anything else is an
+		// address.
+		id, addr := "", cmd[2]
+		if len(cmd[2]) == 28 && strings.HasSuffix(cmd[2], "=") {
+			id, addr = cmd[2], ""
+		}
+		var err error
+		if cmd[1] == "block" {
+			_, err = client.BlockPeer(ctx, &serverpb.BlockPeerRequest{Id: id, Addr: addr})
+		} else {
+			_, err = client.UnblockPeer(ctx, &serverpb.UnblockPeerRequest{Id: id, Addr: addr})
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("OK")
+		}
+	} else if cmd[1] == "block" || cmd[1] == "unblock" {
+		fmt.Println("Please specify a node ID or address.")
 	} else {
 		fmt.Println("Invalid command.")
 	}
@@ -274,6 +331,10 @@ func reference(cmd []string, client serverpb.ClientClient, ctx context.Context)
 }
 
 func publish(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) >= 4 && cmd[1] == "-f" {
+		publishFile(cmd, client, ctx)
+		return
+	}
 	if len(cmd) != 3 {
 		fmt.Println("Incorrect number of arguments.")
 		return
@@ -290,6 +351,55 @@ func publish(cmd []string, client serverpb.ClientClient, ctx context.Context) {
 		PrivKey: privateBody,
 		Message: cmd[1],
 	}
+	sendPublish(args, client, ctx)
+}
+
+// publishFile handles `publish -f <path/to/file> <path/to/priv_key> [key=value ...]`.
+func publishFile(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	args, err := parsePublishFile(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	sendPublish(args, client, ctx)
+}
+
+// parsePublishFile builds the PublishRequest for publish -f. The
+// content-type header overrides the content type inferred from the path.
+func parsePublishFile(cmd []string) (*serverpb.PublishRequest, error) {
+	if len(cmd) < 4 || cmd[1] != "-f" {
+		return nil, errors.Errorf("Incorrect number of arguments.")
+	}
+	data, err := ioutil.ReadFile(cmd[2])
+	if err != nil {
+		return nil, err
+	}
+	privateBody, err := ioutil.ReadFile(cmd[3])
+	if err != nil {
+		return nil, err
+	}
+
+	args := &serverpb.PublishRequest{
+		PrivKey:     privateBody,
+		Data:        data,
+		ContentType: getContentType(cmd[2]),
+		Headers:     make(map[string]string),
+	}
+	for _, header := range cmd[4:] {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Headers should be in the format of 'key=value'.")
+		}
+		if strings.ToLower(parts[0]) == "content-type" {
+			args.ContentType = parts[1]
+			continue
+		}
+		args.Headers[parts[0]] = parts[1]
+	}
+	return args, nil
+}
+
+func sendPublish(args *serverpb.PublishRequest, client serverpb.ClientClient, ctx context.Context) {
 	resp, err := client.Publish(ctx, args)
 	if err != nil {
 		fmt.Println(err)
@@ -325,19 +435,74 @@ func subscribe(cmd []string, client serverpb.ClientClient, ctx context.Context)
 				fmt.Println(err)
 				return
 			}
-			fmt.Println(msg.Message)
+			printMessage(msg)
 		}
 	}()
 
 	for {
-		reader := bufio.NewReader(os.Stdin)
-		input, _ := reader.ReadString('\n')
+		input, _ := stdin.ReadString('\n')
 		if input != "" {
 			return
 		}
 	}
 }
 
+func printMessage(msg *serverpb.Message) {
+	if msg.Message != "" {
+		fmt.Println(msg.Message)
+	}
+	for k, v := range msg.GetHeaders() {
+		fmt.Println(k + ": " + v)
+	}
+	if len(msg.Data) == 0 {
+		return
+	}
+	contentType := msg.GetContentType()
+	if strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json") {
+		fmt.Printf("%s\n", msg.Data)
+	} else {
+		fmt.Printf("<%d bytes of %q>\n", len(msg.Data), contentType)
+	}
+}
+
+func stats(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) != 1 {
+		fmt.Println("Incorrect number of arguments.")
+		return
+	}
+	resp, err := client.GetStats(ctx, &serverpb.GetStatsRequest{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("Routing table filters:")
+	for _, f := range resp.GetFilters() {
+		fmt.Printf("  hops %d: %d keys, %d bits, %d slices, %.4f%% false positives\n",
+			f.Hops, f.Keys, f.Bits, f.Slices, f.FalsePositiveRate*100)
+	}
+}
+
+func providers(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) != 2 {
+		fmt.Println("Incorrect number of arguments.")
+		return
+	}
+	resp, err := client.FindProviders(ctx, &serverpb.FindProvidersRequest{
+		Id: cmd[1],
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(resp.GetProviders()) == 0 {
+		fmt.Println("No providers found.")
+		return
+	}
+	for _, p := range resp.GetProviders() {
+		fmt.Printf("%s  %d hops  %s\n", p.Id, p.NumHops, strings.Join(p.Addrs, ", "))
+	}
+}
+
 func getContentType(fname string) string {
 	return mime.TypeByExtension(filepath.Ext(fname))
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePublishFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-app-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data.json")
+	if err := ioutil.WriteFile(data, []byte(`{"a": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "priv.key")
+	if err := ioutil.WriteFile(key, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := parsePublishFile([]string{"publish", "-f", data, key, "a=b", "c=d=e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(args.Data) != `{"a": 1}` || string(args.PrivKey) != "key" {
+		t.Errorf("unexpected data or key: %+v", args)
+	}
+	if args.ContentType != "application/json" {
+		t.Errorf("expected content type from the extension; got %q", args.ContentType)
+	}
+	if want := map[string]string{"a": "b", "c": "d=e"}; !reflect.DeepEqual(args.Headers, want) {
+		t.Errorf("got headers %+v; wanted %+v", args.Headers, want)
+	}
+
+	args, err = parsePublishFile([]string{"publish", "-f", data, key, "Content-Type=text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.ContentType != "text/plain" || len(args.Headers) != 0 {
+		t.Errorf("expected content-type header to override the content type; got %+v", args)
+	}
+
+	for _, cmd := range [][]string{
+		{"publish", "-f", data},
+		{"publish", "-f", data, key, "noequals"},
+		{"publish", "-f", filepath.Join(dir, "missing"), key},
+	} {
+		if _, err := parsePublishFile(cmd); err == nil {
+			t.Errorf("expected %q to be rejected", cmd)
+		}
+	}
+}
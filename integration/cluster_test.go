@@ -222,6 +222,159 @@ func TestClusterFetchDocument(t *testing.T) {
 	})
 }
 
+func TestClusterFetchDocumentDirect(t *testing.T) {
+	const nodes = 5
+
+	MultiTopologyTest(t, DefaultTopologies, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		doc := serverpb.Document{
+			Data:        []byte("Document from node 0"),
+			ContentType: "text/plain",
+		}
+		resp, err := ts.Nodes[0].Add(ctx, &serverpb.AddRequest{
+			Document: &doc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		documentID, _, err := server.SplitAccessID(resp.AccessId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := ts.Nodes[0].NodeMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, node := range ts.Nodes {
+			util.SucceedsSoon(t, func() error {
+				located, err := node.LocateProvider(ctx, &serverpb.LocateProviderRequest{
+					Id:      documentID,
+					NumHops: -1,
+				})
+				if err != nil {
+					return err
+				}
+				if located.Provider.Id != meta.Id {
+					return errors.Errorf("%d. located %s; wanted %s", i, located.Provider.Id, meta.Id)
+				}
+
+				got, err := node.Get(ctx, &serverpb.GetRequest{
+					AccessId: resp.AccessId,
+				})
+				if err != nil {
+					return errors.Wrapf(err, "fetching document from node %d", i)
+				}
+				if !reflect.DeepEqual(got.Document, &doc) {
+					return errors.Errorf("%d. got %+v; wanted %+v", i, got.Document, &doc)
+				}
+				return nil
+			})
+		}
+	}, func(c *cluster) {
+		c.NodeConfig.DirectFetch = true
+	})
+}
+
+func TestClusterFetchDocumentKademlia(t *testing.T) {
+	const nodes = 5
+
+	MultiTopologyTest(t, DefaultTopologies, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		files := map[string]serverpb.Document{}
+
+		for i, node := range ts.Nodes {
+			doc := serverpb.Document{
+				Data:        []byte(fmt.Sprintf("Document from node %d", i)),
+				ContentType: "text/plain",
+			}
+			resp, err := node.Add(ctx, &serverpb.AddRequest{
+				Document: &doc,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[resp.AccessId] = doc
+		}
+
+		// Check to make sure all nodes can find other nodes files via the DHT.
+		for i, node := range ts.Nodes {
+			for accessID, doc := range files {
+				util.SucceedsSoon(t, func() error {
+					resp, err := node.Get(ctx, &serverpb.GetRequest{
+						AccessId: accessID,
+					})
+					if err != nil {
+						return errors.Wrapf(err, "fetching document %q, from node %d: %s", accessID, i, doc.Data)
+					}
+					if !reflect.DeepEqual(resp.Document, &doc) {
+						return errors.Errorf("%d. got %+v; wanted %+v", i, resp.Document, &doc)
+					}
+					return nil
+				})
+			}
+		}
+	}, func(c *cluster) {
+		c.NodeConfig.Router = server.RouterKademlia
+	})
+}
+
+func TestClusterFindProviders(t *testing.T) {
+	const nodes = 5
+
+	MultiTopologyTest(t, DefaultTopologies, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		resp, err := ts.Nodes[0].Add(ctx, &serverpb.AddRequest{
+			Document: &serverpb.Document{
+				Data:        []byte("Document from node 0"),
+				ContentType: "text/plain",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		meta, err := ts.Nodes[0].NodeMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The node holding the document lists itself.
+		local, err := ts.Nodes[0].FindProviders(ctx, &serverpb.FindProvidersRequest{
+			Id: resp.AccessId,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(local.Providers) == 0 || local.Providers[0].Id != meta.Id || local.Providers[0].NumHops != 0 {
+			t.Fatalf("expected node 0 to provide itself; got %+v", local.Providers)
+		}
+
+		for i, node := range ts.Nodes[1:] {
+			util.SucceedsSoon(t, func() error {
+				found, err := node.FindProviders(ctx, &serverpb.FindProvidersRequest{
+					Id: resp.AccessId,
+				})
+				if err != nil {
+					return err
+				}
+				if len(found.Providers) == 0 {
+					return errors.Errorf("%d. no providers found", i+1)
+				}
+				for _, p := range found.Providers {
+					if p.NumHops < 1 || len(p.Addrs) == 0 {
+						return errors.Errorf("%d. invalid provider %+v", i+1, p)
+					}
+				}
+				return nil
+			})
+		}
+	})
+}
+
 func generatePrivateKey(t *testing.T) []byte {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
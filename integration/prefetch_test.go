@@ -0,0 +1,140 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClusterPrefetchDirectory(t *testing.T) {
+	const nodes = 3
+
+	MultiTopologyTest(t, DefaultTopologies, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		origin := ts.Nodes[0]
+		children := map[string]string{}
+		var childIDs []string
+		for i := 0; i < 3; i++ {
+			resp, err := origin.Add(ctx, &serverpb.AddRequest{
+				Document: &serverpb.Document{
+					Data:        []byte(fmt.Sprintf("asset %d", i)),
+					ContentType: "text/plain",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			children[fmt.Sprintf("asset%d.txt", i)] = resp.AccessId
+			documentID, _, err := server.SplitAccessID(resp.AccessId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			childIDs = append(childIDs, documentID)
+		}
+		dir, err := origin.Add(ctx, &serverpb.AddRequest{
+			Document: &serverpb.Document{
+				ContentType: "directory",
+				Children:    children,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node := ts.Nodes[nodes-1]
+		util.SucceedsSoon(t, func() error {
+			_, err := node.Get(ctx, &serverpb.GetRequest{
+				AccessId: dir.AccessId,
+			})
+			return err
+		})
+
+		// The children should be fetched without being asked for.
+		for _, documentID := range childIDs {
+			util.SucceedsSoon(t, func() error {
+				if _, err := node.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
+					DocumentId: documentID,
+					NumHops:    0,
+				}); err != nil {
+					return errors.Wrapf(err, "child %s not prefetched", documentID)
+				}
+				return nil
+			})
+		}
+	}, func(c *cluster) {
+		c.NodeConfig.PrefetchDepth = 1
+	})
+}
+
+func TestClusterPrefetchBudget(t *testing.T) {
+	const nodes = 3
+
+	MultiTopologyTest(t, DefaultTopologies, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		origin := ts.Nodes[0]
+		add := func(data []byte) string {
+			resp, err := origin.Add(ctx, &serverpb.AddRequest{
+				Document: &serverpb.Document{
+					Data:        data,
+					ContentType: "text/plain",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp.AccessId
+		}
+		// Children are prefetched in name order, so the large one comes
+		// first and would use up the budget if it were fetched.
+		large := add(make([]byte, 10000))
+		small := add([]byte("small asset"))
+		dir, err := origin.Add(ctx, &serverpb.AddRequest{
+			Document: &serverpb.Document{
+				ContentType: "directory",
+				Children: map[string]string{
+					"a.bin": large,
+					"b.txt": small,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node := ts.Nodes[nodes-1]
+		util.SucceedsSoon(t, func() error {
+			_, err := node.Get(ctx, &serverpb.GetRequest{
+				AccessId: dir.AccessId,
+			})
+			return err
+		})
+
+		local := func(accessID string) error {
+			documentID, _, err := server.SplitAccessID(accessID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = node.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
+				DocumentId: documentID,
+				NumHops:    0,
+			})
+			return err
+		}
+		util.SucceedsSoon(t, func() error {
+			return errors.Wrap(local(small), "small child not prefetched")
+		})
+		if err := local(large); err == nil {
+			t.Fatal("expected the child larger than the budget to be skipped")
+		}
+	}, func(c *cluster) {
+		c.NodeConfig.PrefetchDepth = 1
+		c.NodeConfig.PrefetchBytes = 1000
+	})
+}
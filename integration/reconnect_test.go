@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestClusterReconnectOnRestart(t *testing.T) {
+	server.ReconnectInterval = 200 * time.Millisecond
+
+	const nodes = 2
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	for i, node := range ts.Nodes {
+		util.SucceedsSoon(t, func() error {
+			if got := node.NumConnections(); got != nodes-1 {
+				return errors.Errorf("%d. expected %d connections; got %d", i, nodes-1, got)
+			}
+			return nil
+		})
+	}
+
+	// Restart the second node from its data directory without bootstrapping.
+	if err := ts.Nodes[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+	config := ts.NodeConfig
+	config.Path = ts.Dirs[1]
+	s, err := server.New(config)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ts.Nodes[1] = s
+	go func() {
+		if err := s.Listen(":0"); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}()
+
+	for i, node := range ts.Nodes {
+		util.SucceedsSoon(t, func() error {
+			if got := node.NumConnections(); got != nodes-1 {
+				return errors.Errorf("%d. expected %d connections after restart; got %d", i, nodes-1, got)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package integration
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// holders returns the indexes of the nodes storing the document locally.
+func holders(ctx context.Context, ts *cluster, documentID string, skip map[int]bool) []int {
+	var out []int
+	for i, node := range ts.Nodes {
+		if skip[i] {
+			continue
+		}
+		if _, err := node.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
+			DocumentId: documentID,
+			NumHops:    0,
+		}); err == nil {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func TestClusterReplication(t *testing.T) {
+	const nodes = 5
+
+	MultiTopologyTest(t, DefaultTopologies, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		// The last node is at the edge of every topology so the rest stay
+		// connected once it's gone.
+		last := nodes - 1
+		origin := ts.Nodes[last]
+		util.SucceedsSoon(t, func() error {
+			if origin.NumConnections() == 0 {
+				return errors.Errorf("no peers")
+			}
+			return nil
+		})
+
+		doc := serverpb.Document{
+			Data:        []byte("Replicated document"),
+			ContentType: "text/plain",
+		}
+		resp, err := origin.Add(ctx, &serverpb.AddRequest{
+			Document:    &doc,
+			Replication: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		documentID, _, err := server.SplitAccessID(resp.AccessId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		util.SucceedsSoon(t, func() error {
+			if got := holders(ctx, ts, documentID, map[int]bool{last: true}); len(got) != 1 {
+				return errors.Errorf("expected 1 replica; got %v", got)
+			}
+			return nil
+		})
+
+		// The document survives the loss of the node that added it.
+		if err := origin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for i, node := range ts.Nodes[:last] {
+			util.SucceedsSoon(t, func() error {
+				got, err := node.Get(ctx, &serverpb.GetRequest{
+					AccessId: resp.AccessId,
+				})
+				if err != nil {
+					return errors.Wrapf(err, "fetching document from node %d", i)
+				}
+				if !reflect.DeepEqual(got.Document, &doc) {
+					return errors.Errorf("%d. got %+v; wanted %+v", i, got.Document, &doc)
+				}
+				return nil
+			})
+		}
+	}, func(c *cluster) {
+		c.NodeConfig.ReplicaQuota = 1 << 20
+	})
+}
+
+func TestClusterReplicationRepair(t *testing.T) {
+	const nodes = 4
+
+	server.RepairInterval = 200 * time.Millisecond
+
+	MultiTopologyTest(t, []Topology{TopologyFullyConnected}, nodes, func(t *testing.T, ts *cluster) {
+		ctx := context.Background()
+
+		origin := ts.Nodes[0]
+		util.SucceedsSoon(t, func() error {
+			if n := origin.NumConnections(); n != nodes-1 {
+				return errors.Errorf("expected %d peers; got %d", nodes-1, n)
+			}
+			return nil
+		})
+
+		resp, err := origin.Add(ctx, &serverpb.AddRequest{
+			Document: &serverpb.Document{
+				Data:        []byte("Replicated document"),
+				ContentType: "text/plain",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		documentID, _, err := server.SplitAccessID(resp.AccessId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		skip := map[int]bool{0: true}
+		var replicas []int
+		util.SucceedsSoon(t, func() error {
+			if replicas = holders(ctx, ts, documentID, skip); len(replicas) != 1 {
+				return errors.Errorf("expected 1 replica; got %v", replicas)
+			}
+			return nil
+		})
+
+		// Losing the replica should cause it to be pushed to another peer.
+		lost := replicas[0]
+		if err := ts.Nodes[lost].Close(); err != nil {
+			t.Fatal(err)
+		}
+		skip[lost] = true
+		util.SucceedsSoon(t, func() error {
+			if got := holders(ctx, ts, documentID, skip); len(got) != 1 {
+				return errors.Errorf("expected 1 repaired replica; got %v", got)
+			}
+			return nil
+		})
+
+		// Once the node that added it is lost too, the remaining holder
+		// re-replicates it.
+		if err := origin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		skip[0] = true
+		util.SucceedsSoon(t, func() error {
+			if got := holders(ctx, ts, documentID, skip); len(got) != 2 {
+				return errors.Errorf("expected 2 replicas without the origin; got %v", got)
+			}
+			return nil
+		})
+	}, func(c *cluster) {
+		c.NodeConfig.Replication = 1
+		c.NodeConfig.ReplicaQuota = 1 << 20
+	})
+}
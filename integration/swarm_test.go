@@ -0,0 +1,77 @@
+package integration
+
+import (
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestClusterSwarmKey(t *testing.T) {
+	const nodes = 2
+	ts := NewTestCluster(t, nodes, func(c *cluster) {
+		c.NodeConfig.SwarmKey = "swarm a"
+	})
+	defer ts.Close()
+
+	for i, node := range ts.Nodes {
+		util.SucceedsSoon(t, func() error {
+			if got := node.NumConnections(); got != nodes-1 {
+				return errors.Errorf("%d. expected %d connections; got %d", i, nodes-1, got)
+			}
+			return nil
+		})
+	}
+
+	meta, err := ts.Nodes[0].NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", "swarm b"} {
+		config := ts.NodeConfig
+		config.SwarmKey = key
+		outsider := ts.AddNode(config)
+		waitListening(t, outsider)
+
+		if err := outsider.BootstrapAddNode(nil, meta.Addrs[0]); err == nil {
+			t.Errorf("expected node with key %q to be refused", key)
+		}
+		if got := outsider.NumConnections(); got != 0 {
+			t.Errorf("expected node with key %q to have no connections; got %d", key, got)
+		}
+	}
+
+	for i, node := range ts.Nodes[:nodes] {
+		if got := node.NumConnections(); got != nodes-1 {
+			t.Errorf("%d. expected %d connections; got %d", i, nodes-1, got)
+		}
+	}
+
+	// A node with the key can still join.
+	member := ts.AddNode(ts.NodeConfig)
+	waitListening(t, member)
+	if err := member.BootstrapAddNode(nil, meta.Addrs[0]); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	util.SucceedsSoon(t, func() error {
+		if got := member.NumConnections(); got == 0 {
+			return errors.Errorf("expected member to connect")
+		}
+		return nil
+	})
+}
+
+func waitListening(t *testing.T, s *server.Server) {
+	util.SucceedsSoon(t, func() error {
+		meta, err := s.NodeMeta()
+		if err != nil {
+			return err
+		}
+		if len(meta.Addrs) == 0 {
+			return errors.Errorf("no address")
+		}
+		return nil
+	})
+}
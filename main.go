@@ -2,20 +2,36 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"log"
 	"strings"
+	"time"
 
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 )
 
 var (
-	path      = flag.String("path", "tmp/node1", "the path to store data in")
-	bootstrap = flag.String("bootstrap", "", "addresses to bootstrap with, comma separated")
-	bind      = flag.String("bind", ":0", "the address to bind to")
-	maxPeers  = flag.Int("maxPeers", 100, "maximum number of peers")
-	maxWidth  = flag.Int("maxWidth", 20, "maximum graph width of the cluster")
-	cacheSize = flag.Int("cacheSize", 100000000, "cache size of the node")
+	path             = flag.String("path", "tmp/node1", "the path to store data in")
+	bootstrap        = flag.String("bootstrap", "", "addresses to bootstrap with, comma separated")
+	bind             = flag.String("bind", ":0", "the address to bind to")
+	advertise        = flag.String("advertise", "", "addresses to advertise to other nodes, comma separated")
+	maxPeers         = flag.Int("maxPeers", 100, "maximum number of peers")
+	maxWidth         = flag.Int("maxWidth", 20, "maximum graph width of the cluster")
+	cacheSize        = flag.Int("cacheSize", 100000000, "cache size of the node")
+	router           = flag.String("router", "bloom", "how to locate content: bloom or kademlia")
+	hedgeDelay       = flag.Duration("hedgeDelay", 0, "how long to wait for a route before also trying the next, 0 disables")
+	maxFanout        = flag.Int("maxFanout", 2, "maximum number of routes a hedged fetch has in flight")
+	directFetch      = flag.Bool("directFetch", false, "fetch documents directly from the node holding them instead of relaying")
+	replication      = flag.Int("replication", 0, "number of peers to push new documents to")
+	replicaQuota     = flag.Int64("replicaQuota", 1000000000, "maximum bytes of replicas to store for other nodes, 0 refuses replicas")
+	prefetchDepth    = flag.Int("prefetchDepth", 0, "levels of a directory's children to fetch in the background, 0 disables")
+	prefetchBytes    = flag.Int64("prefetchBytes", 10000000, "maximum bytes fetched by a directory prefetch, 0 for no limit")
+	negativeCacheTTL = flag.Duration("negativeCacheTTL", 5*time.Second, "how long to remember failed lookups, 0 disables")
+	banDuration      = flag.Duration("banDuration", 10*time.Minute, "how long to ban peers that send invalid data, 0 disables")
+	swarmKey         = flag.String("swarmKey", "", "file containing the pre-shared key of a private network")
+	discovery        = flag.Bool("discovery", false, "announce this node and discover peers on the local network")
+	discoveryAddr    = flag.String("discoveryAddr", server.DefaultDiscoveryAddr, "multicast group to use for local network discovery")
 )
 
 func main() {
@@ -27,11 +43,43 @@ func main() {
 func run() error {
 	flag.Parse()
 
+	var advertiseAddrs []string
+	if len(*advertise) > 0 {
+		advertiseAddrs = strings.Split(*advertise, ",")
+	}
+
+	var key string
+	if len(*swarmKey) > 0 {
+		body, err := ioutil.ReadFile(*swarmKey)
+		if err != nil {
+			return err
+		}
+		key = strings.TrimSpace(string(body))
+	}
+
+	var discoveryGroup string
+	if *discovery {
+		discoveryGroup = *discoveryAddr
+	}
+
 	s, err := server.New(serverpb.NodeConfig{
-		Path:      *path,
-		MaxPeers:  int32(*maxPeers),
-		MaxWidth:  int32(*maxWidth),
-		CacheSize: int64(*cacheSize),
+		Path:             *path,
+		MaxPeers:         int32(*maxPeers),
+		MaxWidth:         int32(*maxWidth),
+		CacheSize:        int64(*cacheSize),
+		Router:           *router,
+		HedgeDelay:       int64(*hedgeDelay / time.Millisecond),
+		MaxFanout:        int32(*maxFanout),
+		DirectFetch:      *directFetch,
+		NegativeCacheTtl: int64(*negativeCacheTTL / time.Millisecond),
+		Replication:      int32(*replication),
+		ReplicaQuota:     *replicaQuota,
+		PrefetchDepth:    int32(*prefetchDepth),
+		PrefetchBytes:    *prefetchBytes,
+		Advertise:        advertiseAddrs,
+		BanDuration:      int64(*banDuration / time.Millisecond),
+		SwarmKey:         key,
+		DiscoveryAddr:    discoveryGroup,
 	})
 	if err != nil {
 		return err
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/x509"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// interfaceIPs returns the unicast IPs of the host's interfaces that are up,
+// IPv4 first. Loopback and link local addresses are skipped.
+func interfaceIPs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				continue
+			}
+			if ip.To4() != nil {
+				v4 = append(v4, ip)
+			} else {
+				v6 = append(v6, ip)
+			}
+		}
+	}
+	return append(v4, v6...), nil
+}
+
+// splitAdvertise splits an advertised address into its host and port. The
+// port is empty if the address is just a host.
+func splitAdvertise(addr string) (string, string, error) {
+	if net.ParseIP(addr) != nil {
+		return addr, "", nil
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return addr[1 : len(addr)-1], "", nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// A hostname without a port.
+		return addr, "", nil
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", "", errors.Wrapf(err, "invalid port in advertised address %q", addr)
+	}
+	return host, port, nil
+}
+
+// listenAddrs returns the addresses the node is reachable at given the
+// address it's listening on. Advertised addresses take precedence, otherwise
+// every interface address is used when listening on all interfaces. Loopback
+// and link local addresses mean something else to every peer, so localhost is
+// only advertised when the host has no other address.
+func (s *Server) listenAddrs(addr *net.TCPAddr) ([]string, error) {
+	port := strconv.Itoa(addr.Port)
+
+	if len(s.config.Advertise) > 0 {
+		var addrs []string
+		for _, a := range s.config.Advertise {
+			host, p, err := splitAdvertise(a)
+			if err != nil {
+				return nil, err
+			}
+			if p == "" {
+				p = port
+			}
+			addrs = append(addrs, net.JoinHostPort(host, p))
+		}
+		return addrs, nil
+	}
+
+	if !addr.IP.IsUnspecified() {
+		return []string{addr.String()}, nil
+	}
+
+	ips, err := interfaceIPs()
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return []string{net.JoinHostPort("localhost", port)}, nil
+	}
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// certHosts returns the hosts the node's certificate must be valid for. It
+// includes localhost, which isn't advertised, so local clients can connect.
+func (s *Server) certHosts() ([]string, error) {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	ips, err := interfaceIPs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		hosts = append(hosts, ip.String())
+	}
+	for _, a := range s.config.Advertise {
+		host, _, err := splitAdvertise(a)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// certCovers returns whether the certificate is valid for all of the hosts.
+func certCovers(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if err := cert.VerifyHostname(host); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"reflect"
+	"testing"
+)
+
+func TestListenAddrs(t *testing.T) {
+	s := &Server{
+		config: serverpb.NodeConfig{
+			Advertise: []string{"example.com", "1.2.3.4:9000", "2001:db8::1", "[2001:db8::2]:9001", "[2001:db8::3]"},
+		},
+	}
+	addrs, err := s.listenAddrs(&net.TCPAddr{IP: net.IPv6unspecified, Port: 8181})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"example.com:8181", "1.2.3.4:9000", "[2001:db8::1]:8181", "[2001:db8::2]:9001", "[2001:db8::3]:8181"}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("got %v; wanted %v", addrs, want)
+	}
+
+	// Without advertised addresses every interface is used. Loopback is
+	// only advertised if there's nothing else.
+	s.config.Advertise = nil
+	addrs, err = s.listenAddrs(&net.TCPAddr{IP: net.IPv4zero, Port: 8181})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := interfaceIPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) == 0 {
+		if want := []string{"localhost:8181"}; !reflect.DeepEqual(addrs, want) {
+			t.Fatalf("got %v; wanted %v", addrs, want)
+		}
+	} else if len(addrs) != len(ips) {
+		t.Fatalf("expected an address per interface IP %v; got %v", ips, addrs)
+	}
+	for _, addr := range addrs {
+		if err := validateAddr(addr); err != nil {
+			t.Errorf("%q: %+v", addr, err)
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := net.ParseIP(host); len(ips) > 0 && (host == "localhost" || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			t.Errorf("advertised local only address %q", addr)
+		}
+	}
+
+	addrs, err = s.listenAddrs(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 8181})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[::1]:8181"}; !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("got %v; wanted %v", addrs, want)
+	}
+}
+
+func TestCertCoversAdvertised(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := serverpb.NodeConfig{
+		Path: dir,
+	}
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Advertising new addresses reissues the certificate with the same key.
+	c.Advertise = []string{"example.com:8181", "2001:db8::1"}
+	s2, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	if marshal(t, s.key) != marshal(t, s2.key) {
+		t.Fatal("key changed when certificate was reissued")
+	}
+	cert, err := x509.ParseCertificate(s2.cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "example.com", "2001:db8::1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("certificate not valid for %s: %+v", host, err)
+		}
+	}
+}
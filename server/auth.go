@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrIdentity = errors.New("client certificate doesn't match node identity")
+	ErrNotLocal = status.Error(codes.PermissionDenied, "only local callers are allowed")
+)
+
+// localOnlyPaths are the gateway paths of RPCs that only local callers may
+// make. The gateway calls the RPCs over a connection to the node itself, so
+// the original caller's address has to be checked before that.
+var localOnlyPaths = []string{"/v1/blocklist"}
+
+// isNodeRPC returns whether the method is part of the node to node service.
+func isNodeRPC(method string) bool {
+	return strings.HasPrefix(method, "/serverpb.Node/")
+}
+
+// isClientRPC returns whether the method is part of the client service.
+func isClientRPC(method string) bool {
+	return strings.HasPrefix(method, "/serverpb.Client/")
+}
+
+// callerID returns the node ID of the client certificate the caller connected
+// with. The TLS handshake proves the caller holds the certificate's key, so
+// the ID can't be spoofed.
+func callerID(ctx context.Context) (string, error) {
+	p, ok := grpcpeer.FromContext(ctx)
+	if !ok {
+		return "", errors.Errorf("missing peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", errors.Errorf("connection from %s isn't TLS", p.Addr)
+	}
+	certs := info.State.PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.Errorf("missing client certificate from %s", p.Addr)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return nodeMetaId(serverpb.NodeMeta{PublicKey: string(publicKey)}), nil
+}
+
+// isLocalAddr returns whether the host:port address belongs to this machine,
+// either a loopback address or one of its interface addresses. Connections the
+// node makes to itself on a specific interface come from that address.
+func isLocalAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireLocalCaller refuses RPCs that didn't come from the local machine.
+// Calls without a peer were made in process.
+func requireLocalCaller(ctx context.Context) error {
+	p, ok := grpcpeer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if p.Addr == nil || !isLocalAddr(p.Addr.String()) {
+		return ErrNotLocal
+	}
+	return nil
+}
+
+// localOnlyGateway refuses gateway requests for local only RPCs that didn't
+// come from the local machine.
+func localOnlyGateway(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range localOnlyPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) && !isLocalAddr(r.RemoteAddr) {
+				http.Error(w, ErrNotLocal.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkCaller verifies that the caller's client certificate belongs to the
+// node with the given ID.
+func checkCaller(ctx context.Context, id string) error {
+	got, err := callerID(ctx)
+	if err != nil {
+		return err
+	}
+	if got != id {
+		return errors.Wrapf(ErrIdentity, "claimed %s, certificate is for %s", id, got)
+	}
+	return nil
+}
+
+// authorizeNodeRPC requires Node RPCs to come from a node with a client
+// certificate that isn't blocked and, in a private network, holds the swarm
+// key. Meta stays open so nodes can be bootstrapped.
+func (s *Server) authorizeNodeRPC(ctx context.Context, method string) error {
+	if !isNodeRPC(method) || method == "/serverpb.Node/Meta" {
+		return nil
+	}
+	id, err := callerID(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "calling %s", method)
+	}
+	s.mu.Lock()
+	blocked := s.blockedIDLocked(id)
+	s.mu.Unlock()
+	if blocked {
+		return errors.Wrapf(ErrBlocked, "node %s calling %s", id, method)
+	}
+	return s.checkSwarmRPC(ctx, method, id)
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorizeNodeRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	if err := s.checkSwarmClientRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorizeNodeRPC(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	if err := s.checkSwarmClientRPC(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	grpcpeer "google.golang.org/grpc/peer"
+)
+
+func TestCallerID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	meta, err := s.NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(s.cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	withCert := grpcpeer.NewContext(context.Background(), &grpcpeer.Peer{
+		Addr: addr,
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+		}},
+	})
+	withoutCert := grpcpeer.NewContext(context.Background(), &grpcpeer.Peer{
+		Addr:     addr,
+		AuthInfo: credentials.TLSInfo{},
+	})
+
+	if id, err := callerID(withCert); err != nil || id != meta.Id {
+		t.Errorf("callerID = %q, %v; expected %q", id, err, meta.Id)
+	}
+	if err := checkCaller(withCert, meta.Id); err != nil {
+		t.Errorf("expected caller to match: %+v", err)
+	}
+	if err := checkCaller(withCert, "spoofed"); err == nil {
+		t.Error("expected a spoofed ID to be refused")
+	}
+	if err := checkCaller(withoutCert, meta.Id); err == nil {
+		t.Error("expected a caller without a certificate to be refused")
+	}
+
+	cases := []struct {
+		ctx    context.Context
+		method string
+		ok     bool
+	}{
+		{withCert, "/serverpb.Node/GetRoutingTable", true},
+		{withoutCert, "/serverpb.Node/GetRoutingTable", false},
+		{context.Background(), "/serverpb.Node/Hello", false},
+		{withoutCert, "/serverpb.Node/Meta", true},
+		{withoutCert, "/serverpb.Client/Get", true},
+	}
+	for i, c := range cases {
+		if err := s.authorizeNodeRPC(c.ctx, c.method); (err == nil) != c.ok {
+			t.Errorf("%d. authorizeNodeRPC(%s) = %v; expected ok %t", i, c.method, err, c.ok)
+		}
+	}
+
+	if _, err := s.BlockPeer(context.Background(), &serverpb.BlockPeerRequest{Id: meta.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.authorizeNodeRPC(withCert, "/serverpb.Node/GetRoutingTable"); err == nil {
+		t.Error("expected blocked node to be refused")
+	}
+}
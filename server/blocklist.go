@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"net"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+var ErrBlocked = errors.New("peer is blocked")
+
+const (
+	blocklistPrefix = "/blocklist/"
+
+	// invalidDataScore is subtracted from a peer's score each time it sends
+	// data that fails verification.
+	invalidDataScore = 10
+	// maxPeerScore caps how much good behaviour can offset later bad data.
+	maxPeerScore = 10
+	// banScore is the score at which a peer is banned.
+	banScore = -30
+)
+
+// banDuration is how long misbehaving peers are banned for.
+func (s *Server) banDuration() time.Duration {
+	return time.Duration(s.config.BanDuration) * time.Millisecond
+}
+
+// scoreValid records that the peer sent data that passed verification.
+func (s *Server) scoreValid(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mu.scores[id] < maxPeerScore {
+		s.mu.scores[id]++
+	}
+}
+
+// scoreInvalid records that the peer sent data that failed verification and
+// bans it once its score gets too low.
+func (s *Server) scoreInvalid(id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mu.scores[id] -= invalidDataScore
+	s.log.Printf("invalid data from %s (score %d): %+v", color.RedString(id), s.mu.scores[id], err)
+
+	d := s.banDuration()
+	if d <= 0 || s.mu.scores[id] > banScore {
+		return
+	}
+	s.log.Printf("banning %s for %s", color.RedString(id), d)
+	s.mu.bans[id] = time.Now().Add(d)
+	delete(s.mu.scores, id)
+	if p, ok := s.mu.peers[id]; ok {
+		p.closeLocked()
+	}
+}
+
+// bannedLocked returns whether the node is currently banned.
+func (s *Server) bannedLocked(id string) bool {
+	until, ok := s.mu.bans[id]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(s.mu.bans, id)
+		return false
+	}
+	return true
+}
+
+// blockedIDLocked returns whether the node is banned or on the blocklist.
+func (s *Server) blockedIDLocked(id string) bool {
+	if s.bannedLocked(id) {
+		return true
+	}
+	_, ok := s.mu.blocklist[blocklistKey(serverpb.BlocklistEntry{Id: id})]
+	return ok
+}
+
+// blockedAddrLocked returns whether the address or its host is on the
+// blocklist.
+func (s *Server) blockedAddrLocked(addr string) bool {
+	if _, ok := s.mu.blocklist[blocklistKey(serverpb.BlocklistEntry{Addr: addr})]; ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	_, ok := s.mu.blocklist[blocklistKey(serverpb.BlocklistEntry{Addr: host})]
+	return ok
+}
+
+// isBlocked returns whether the node is banned or blocked by ID or by any of
+// its addresses.
+func (s *Server) isBlocked(meta serverpb.NodeMeta) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.blockedIDLocked(meta.Id) {
+		return true
+	}
+	for _, addr := range meta.Addrs {
+		if s.blockedAddrLocked(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockedAddr returns whether the address is on the blocklist.
+func (s *Server) isBlockedAddr(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.blockedAddrLocked(addr)
+}
+
+// withoutBlocked removes routes through banned or blocked nodes.
+func (s *Server) withoutBlocked(routes []Route) []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Route
+	for _, route := range routes {
+		if !s.blockedIDLocked(route.ID) {
+			out = append(out, route)
+		}
+	}
+	return out
+}
+
+// normalizeBlocklistEntry validates the entry and strips brackets from bare
+// IPv6 hosts so they match the host of an address.
+func normalizeBlocklistEntry(entry serverpb.BlocklistEntry) (serverpb.BlocklistEntry, error) {
+	if (entry.Id == "") == (entry.Addr == "") {
+		return serverpb.BlocklistEntry{}, errors.Errorf("exactly one of id and addr must be set")
+	}
+	if entry.Addr != "" {
+		if _, _, err := net.SplitHostPort(entry.Addr); err != nil {
+			entry.Addr = strings.TrimSuffix(strings.TrimPrefix(entry.Addr, "["), "]")
+		}
+	}
+	return entry, nil
+}
+
+func blocklistKey(entry serverpb.BlocklistEntry) string {
+	if entry.Id != "" {
+		return "id/" + entry.Id
+	}
+	return "addr/" + entry.Addr
+}
+
+// loadBlocklist loads the persisted blocklist.
+func (s *Server) loadBlocklist() error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(blocklistPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			body, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var entry serverpb.BlocklistEntry
+			if err := entry.Unmarshal(body); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.mu.blocklist[blocklistKey(entry)] = entry
+			s.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+// BlockPeer adds a node ID or address to the blocklist and disconnects any
+// matching peers. Only local callers may change the blocklist.
+func (s *Server) BlockPeer(ctx context.Context, req *serverpb.BlockPeerRequest) (*serverpb.BlockPeerResponse, error) {
+	if err := requireLocalCaller(ctx); err != nil {
+		return nil, err
+	}
+	entry, err := normalizeBlocklistEntry(serverpb.BlocklistEntry{
+		Id:    req.GetId(),
+		Addr:  req.GetAddr(),
+		Added: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := entry.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	key := blocklistKey(entry)
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(blocklistPrefix+key), body)
+	}); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.mu.blocklist[key] = entry
+	var blocked []*peer
+	for _, p := range s.mu.peers {
+		blocked = append(blocked, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range blocked {
+		if s.isBlocked(p.meta) {
+			s.log.Printf("disconnecting blocked peer %s", color.RedString(p.meta.Id))
+			p.Close()
+		}
+	}
+
+	return &serverpb.BlockPeerResponse{}, nil
+}
+
+// UnblockPeer removes a node ID or address from the blocklist. Unblocking an
+// ID also lifts any ban on it. Only local callers may change the blocklist.
+func (s *Server) UnblockPeer(ctx context.Context, req *serverpb.UnblockPeerRequest) (*serverpb.UnblockPeerResponse, error) {
+	if err := requireLocalCaller(ctx); err != nil {
+		return nil, err
+	}
+	entry, err := normalizeBlocklistEntry(serverpb.BlocklistEntry{
+		Id:   req.GetId(),
+		Addr: req.GetAddr(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	key := blocklistKey(entry)
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(blocklistPrefix + key))
+	}); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	delete(s.mu.blocklist, key)
+	if entry.Id != "" {
+		delete(s.mu.bans, entry.Id)
+	}
+	s.mu.Unlock()
+
+	return &serverpb.UnblockPeerResponse{}, nil
+}
+
+// GetBlocklist returns the blocklist and the currently banned peers to local
+// callers.
+func (s *Server) GetBlocklist(ctx context.Context, req *serverpb.GetBlocklistRequest) (*serverpb.GetBlocklistResponse, error) {
+	if err := requireLocalCaller(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &serverpb.GetBlocklistResponse{}
+	for _, entry := range s.mu.blocklist {
+		entry := entry
+		resp.Entries = append(resp.Entries, &entry)
+	}
+	for id, until := range s.mu.bans {
+		if !s.bannedLocked(id) {
+			continue
+		}
+		resp.Bans = append(resp.Bans, &serverpb.Ban{
+			Id:    id,
+			Until: until.Unix(),
+		})
+	}
+	return resp, nil
+}
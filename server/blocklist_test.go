@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestScoreBan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path:        dir,
+		BanDuration: 60000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	invalid := errors.New("invalid")
+	s.scoreValid("a")
+	for i := 0; i < 3; i++ {
+		s.scoreInvalid("a", invalid)
+	}
+	if s.isBlocked(serverpb.NodeMeta{Id: "a"}) {
+		t.Fatal("expected earlier valid data to offset a ban")
+	}
+	s.scoreInvalid("a", invalid)
+	if !s.isBlocked(serverpb.NodeMeta{Id: "a"}) {
+		t.Fatal("expected a to be banned")
+	}
+	if routes := s.withoutBlocked([]Route{{ID: "a"}, {ID: "b"}}); len(routes) != 1 || routes[0].ID != "b" {
+		t.Errorf("expected only the route through b; got %+v", routes)
+	}
+
+	if _, err := s.UnblockPeer(context.Background(), &serverpb.UnblockPeerRequest{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.isBlocked(serverpb.NodeMeta{Id: "a"}) {
+		t.Error("expected unblocking to lift the ban")
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, req := range []*serverpb.BlockPeerRequest{
+		{Id: "a"},
+		{Addr: "10.0.0.1"},
+		{Addr: "[2001:db8::1]"},
+		{Addr: "10.0.0.2:8181"},
+	} {
+		if _, err := s.BlockPeer(ctx, req); err != nil {
+			t.Fatalf("%+v: %+v", req, err)
+		}
+	}
+	if _, err := s.BlockPeer(ctx, &serverpb.BlockPeerRequest{}); err == nil {
+		t.Error("expected an empty entry to be rejected")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocklist should survive a restart.
+	s, err = New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cases := []struct {
+		meta    serverpb.NodeMeta
+		blocked bool
+	}{
+		{serverpb.NodeMeta{Id: "a"}, true},
+		{serverpb.NodeMeta{Id: "b", Addrs: []string{"10.0.0.1:8181"}}, true},
+		{serverpb.NodeMeta{Id: "b", Addrs: []string{"10.0.0.3:8181", "[2001:db8::1]:8181"}}, true},
+		{serverpb.NodeMeta{Id: "b", Addrs: []string{"10.0.0.2:8181"}}, true},
+		{serverpb.NodeMeta{Id: "b", Addrs: []string{"10.0.0.2:8282"}}, false},
+		{serverpb.NodeMeta{Id: "b", Addrs: []string{"10.0.0.3:8181"}}, false},
+	}
+	for i, c := range cases {
+		if got := s.isBlocked(c.meta); got != c.blocked {
+			t.Errorf("%d. isBlocked(%+v) = %t; expected %t", i, c.meta, got, c.blocked)
+		}
+	}
+
+	resp, err := s.GetBlocklist(ctx, &serverpb.GetBlocklistRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 4 {
+		t.Errorf("expected 4 entries; got %+v", resp.Entries)
+	}
+
+	if _, err := s.UnblockPeer(ctx, &serverpb.UnblockPeerRequest{Addr: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.isBlocked(cases[1].meta) {
+		t.Error("expected 10.0.0.1 to be unblocked")
+	}
+}
+
+func TestBlocklistLocalOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	local := grpcpeer.NewContext(context.Background(), &grpcpeer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+	})
+	remote := grpcpeer.NewContext(context.Background(), &grpcpeer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 1234},
+	})
+
+	if _, err := s.BlockPeer(local, &serverpb.BlockPeerRequest{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.BlockPeer(remote, &serverpb.BlockPeerRequest{Id: "b"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected BlockPeer from a remote caller to be denied; got %+v", err)
+	}
+	if _, err := s.UnblockPeer(remote, &serverpb.UnblockPeerRequest{Id: "a"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected UnblockPeer from a remote caller to be denied; got %+v", err)
+	}
+	if _, err := s.GetBlocklist(remote, &serverpb.GetBlocklistRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected GetBlocklist from a remote caller to be denied; got %+v", err)
+	}
+	if !s.isBlocked(serverpb.NodeMeta{Id: "a"}) {
+		t.Error("expected a to still be blocked")
+	}
+
+	// The gateway reaches the RPCs through a connection to the node itself,
+	// so it checks the address the HTTP request came from.
+	handler := localOnlyGateway(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		path, remoteAddr string
+		code             int
+	}{
+		{"/v1/blocklist", "127.0.0.1:1234", http.StatusOK},
+		{"/v1/blocklist", "203.0.113.1:1234", http.StatusForbidden},
+		{"/v1/stats", "203.0.113.1:1234", http.StatusOK},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest("DELETE", c.path, nil)
+		req.RemoteAddr = c.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%d. %s from %s = %d; expected %d", i, c.path, c.remoteAddr, w.Code, c.code)
+		}
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/dgraph-io/badger"
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
-	"github.com/willf/bloom"
 )
 
 var (
@@ -18,16 +17,16 @@ var (
 )
 
 const (
-	NumberOfKeys             = 100000
 	FalsePositiveProbability = 0.01
-)
 
-func createNewBloomFilter() *bloom.BloomFilter {
-	return bloom.NewWithEstimates(NumberOfKeys, FalsePositiveProbability)
-}
+	// routingTableMaxBackoff is the maximum multiple of RoutingTableInterval
+	// that polling backs off to while no routing tables are changing.
+	routingTableMaxBackoff = 4
+)
 
 type Route struct {
 	ID      string
+	Addrs   []string
 	Client  serverpb.NodeClient
 	NumHops int32
 }
@@ -38,17 +37,17 @@ func (s *Server) peersWithFile(documentID string) []Route {
 
 	var routes []Route
 	for id, peer := range s.mu.peers {
-		if peer.routingTable == nil {
+		if peer.routingTable == nil || peer.penalty >= routingPenaltyThreshold {
 			continue
 		}
 
 		for hops, bf := range peer.routingTable.Filters {
-			if len(bf.Data) == 0 {
+			if len(bf.Slices) == 0 {
 				continue
 			}
 
-			var filter bloom.BloomFilter
-			if err := filter.GobDecode(bf.Data); err != nil {
+			filter, err := decodeFilter(bf)
+			if err != nil {
 				s.log.Printf("failed to decode filter for node %+v: %+v", id, err)
 				continue
 			}
@@ -56,6 +55,7 @@ func (s *Server) peersWithFile(documentID string) []Route {
 			if filter.TestString(documentID) {
 				routes = append(routes, Route{
 					ID:      id,
+					Addrs:   s.mu.peerMeta[id].Addrs,
 					Client:  peer.client,
 					NumHops: int32(hops + 1),
 				})
@@ -63,8 +63,22 @@ func (s *Server) peersWithFile(documentID string) []Route {
 		}
 	}
 
+	// Skip peers that are currently failing, unless they're the only option.
+	var healthy []Route
+	for _, route := range routes {
+		if !s.mu.peers[route.ID].stats.failing() {
+			healthy = append(healthy, route)
+		}
+	}
+	if len(healthy) > 0 {
+		routes = healthy
+	}
+
 	sort.Slice(routes, func(i, j int) bool {
-		return routes[i].NumHops < routes[j].NumHops
+		if routes[i].NumHops != routes[j].NumHops {
+			return routes[i].NumHops < routes[j].NumHops
+		}
+		return s.mu.peers[routes[i].ID].stats.cost() < s.mu.peers[routes[j].ID].stats.cost()
 	})
 
 	return routes
@@ -74,22 +88,28 @@ func (s *Server) addToRoutingTable(documentID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.mu.rebuildingRoutingTable {
+		s.mu.rebuildAdds = append(s.mu.rebuildAdds, documentID)
+	}
+
 	table := s.mu.routingTable
 
-	filter := createNewBloomFilter()
-	if len(table.Filters) > 0 {
-		if err := filter.GobDecode(table.Filters[0].Data); err != nil {
+	filter := newScalableFilter(0)
+	if len(table.Filters) > 0 && len(table.Filters[0].Slices) > 0 {
+		var err error
+		filter, err = decodeFilter(table.Filters[0])
+		if err != nil {
 			return err
 		}
 	}
 
 	filter.AddString(documentID)
-	data, err := filter.GobEncode()
+	entry, err := filter.encode()
 	if err != nil {
 		return err
 	}
-	entry := &serverpb.BloomFilter{
-		Data: data,
+	if err := signFilter(entry, s.key); err != nil {
+		return err
 	}
 	if len(table.Filters) > 0 {
 		table.Filters[0] = entry
@@ -101,6 +121,92 @@ func (s *Server) addToRoutingTable(documentID string) error {
 	return nil
 }
 
+// invalidateRoutingTable marks the local filter as stale after a document or
+// reference has been deleted. Bloom filters don't support removal so the filter
+// is rebuilt from the database on the next routing table interval.
+func (s *Server) invalidateRoutingTable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mu.routingTableStale = true
+}
+
+// rebuildRoutingTableIfStale rebuilds the local filter if anything has been
+// deleted since it was last built.
+func (s *Server) rebuildRoutingTableIfStale() error {
+	s.mu.Lock()
+	stale := s.mu.routingTableStale
+	s.mu.Unlock()
+
+	if !stale {
+		return nil
+	}
+	return s.rebuildRoutingTable()
+}
+
+// rebuildRoutingTable replaces the local filter with one containing exactly the
+// documents and references currently stored.
+func (s *Server) rebuildRoutingTable() error {
+	s.mu.Lock()
+	s.mu.routingTableStale = false
+	s.mu.rebuildingRoutingTable = true
+	s.mu.rebuildAdds = nil
+	s.mu.Unlock()
+
+	var ids []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for _, prefix := range [][]byte{[]byte("/document/"), []byte("/reference/")} {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				ids = append(ids, path.Base(string(it.Item().Key())))
+			}
+		}
+		return nil
+	})
+
+	// Leave room for the filter to grow before it needs another slice.
+	filter := newScalableFilter(uint64(len(ids)) * filterGrowth)
+	for _, id := range ids {
+		filter.AddString(id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Include anything added while the database was being scanned.
+	for _, id := range s.mu.rebuildAdds {
+		filter.AddString(id)
+	}
+	s.mu.rebuildingRoutingTable = false
+	s.mu.rebuildAdds = nil
+
+	if err != nil {
+		s.mu.routingTableStale = true
+		return err
+	}
+
+	entry, err := filter.encode()
+	if err != nil {
+		s.mu.routingTableStale = true
+		return err
+	}
+	if err := signFilter(entry, s.key); err != nil {
+		s.mu.routingTableStale = true
+		return err
+	}
+	if len(s.mu.routingTable.Filters) > 0 {
+		s.mu.routingTable.Filters[0] = entry
+	} else {
+		s.mu.routingTable.Filters = append(s.mu.routingTable.Filters, entry)
+	}
+
+	return nil
+}
+
 // GetRoutingTable returns the local nodes routing table.
 func (s *Server) GetRoutingTable(ctx context.Context, previousRT *serverpb.RoutingTable) (*serverpb.RoutingTable, error) {
 	s.mu.Lock()
@@ -108,7 +214,14 @@ func (s *Server) GetRoutingTable(ctx context.Context, previousRT *serverpb.Routi
 
 	rt := s.mu.routingTable
 
-	for _, peer := range s.mu.peers {
+	// Merge peers in a fixed order so an unchanged table keeps its version.
+	var ids []string
+	for id := range s.mu.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		peer := s.mu.peers[id]
 		if peer.routingTable == nil {
 			continue
 		}
@@ -120,18 +233,48 @@ func (s *Server) GetRoutingTable(ctx context.Context, previousRT *serverpb.Routi
 		rt = *merged
 	}
 
+	version, err := routingTableVersion(rt)
+	if err != nil {
+		return nil, err
+	}
+	if previousRT != nil && previousRT.Version == version {
+		return &serverpb.RoutingTable{
+			Version:   version,
+			Unchanged: true,
+		}, nil
+	}
+	rt.Version = version
+
 	return &rt, nil
 }
 
+// routingTableVersion returns a hash identifying the filters in the table.
+func routingTableVersion(rt serverpb.RoutingTable) (string, error) {
+	rt.Version = ""
+	rt.Unchanged = false
+	body, err := rt.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return HashBytes(body), nil
+}
+
+// ReceiveNewRoutingTable polls peers for their routing tables. Polling backs
+// off while nothing changes and resets as soon as a table or peer does.
 func (s *Server) ReceiveNewRoutingTable() {
-	ticker := time.NewTicker(RoutingTableInterval)
+	interval := RoutingTableInterval
+	numPeers := 0
 	for {
 		select {
-		case <-ticker.C:
+		case <-time.After(interval):
 		case <-s.ctx.Done():
 			return
 		}
 
+		if err := s.rebuildRoutingTableIfStale(); err != nil {
+			s.log.Printf("rebuild routing table error: %+v", err)
+		}
+
 		peers := map[string]*peer{}
 
 		tableCount := 0
@@ -152,22 +295,48 @@ func (s *Server) ReceiveNewRoutingTable() {
 		s.mu.Unlock()
 		s.log.Printf("fetching routing tables... have %d, depth %d", tableCount, maxDepth)
 
+		changed := len(peers) != numPeers
+		numPeers = len(peers)
 		for id, peer := range peers {
 			ctx, _ := context.WithTimeout(s.ctx, 10*time.Second)
 
-			if err := s.receiveTableOfPeer(ctx, id, peer); err != nil {
+			peerChanged, err := s.receiveTableOfPeer(ctx, id, peer)
+			if err != nil {
 				s.log.Printf("get routing table error: %s: %+v", color.RedString(id), err)
 
 				s.mu.Lock()
 				peer.routingTable = nil
 				s.mu.Unlock()
 
+				changed = true
 				continue
 			}
+			if peerChanged {
+				changed = true
+			}
+			// Penalties decay over time so peers can recover from transient
+			// failures.
+			s.forgive(id)
 		}
+
+		interval = nextPollInterval(interval, changed)
 	}
 }
 
+// nextPollInterval returns how long to wait before polling peers again. It
+// resets to RoutingTableInterval when anything changed and otherwise doubles
+// up to routingTableMaxBackoff times that.
+func nextPollInterval(interval time.Duration, changed bool) time.Duration {
+	if changed {
+		return RoutingTableInterval
+	}
+	interval *= 2
+	if max := routingTableMaxBackoff * RoutingTableInterval; interval > max {
+		interval = max
+	}
+	return interval
+}
+
 // helpers
 // add to filters
 func (s *Server) getLocalId() (string, error) {
@@ -185,11 +354,11 @@ func (s *Server) CheckNumHopsToGetToFile(documentID string) (int, error) {
 	}
 
 	for i, bf := range rt.Filters {
-		if len(bf.Data) == 0 {
+		if len(bf.Slices) == 0 {
 			continue
 		}
-		var filter bloom.BloomFilter
-		if err := filter.GobDecode(bf.Data); err != nil {
+		filter, err := decodeFilter(bf)
+		if err != nil {
 			return 0, err
 		}
 
@@ -202,18 +371,39 @@ func (s *Server) CheckNumHopsToGetToFile(documentID string) (int, error) {
 	return 0, errors.Errorf("missing Document: %+v", documentID)
 }
 
-func (s *Server) receiveTableOfPeer(ctx context.Context, remoteID string, peer *peer) error {
-	remoteTable, err := peer.client.GetRoutingTable(ctx, &serverpb.RoutingTable{})
+// receiveTableOfPeer fetches the routing table of the peer if it has changed
+// since the last fetch and returns whether it did.
+func (s *Server) receiveTableOfPeer(ctx context.Context, remoteID string, peer *peer) (bool, error) {
+	s.mu.Lock()
+	version := peer.routingTable.GetVersion()
+	s.mu.Unlock()
+
+	remoteTable, err := peer.client.GetRoutingTable(ctx, &serverpb.RoutingTable{
+		Version: version,
+	})
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if remoteTable.Unchanged && peer.routingTable != nil && peer.routingTable.Version == remoteTable.Version {
+		return false, nil
+	}
+	if remoteTable.Unchanged {
+		return false, errors.Errorf("peer claimed unknown version %q was unchanged", remoteTable.Version)
+	}
+
+	if err := checkRoutingTable(remoteTable, peer.meta); err != nil {
+		peer.penalizeLocked()
+		return false, err
+	}
+
+	s.invalidateNotFoundLocked(peer.routingTable, remoteTable)
 	peer.routingTable = remoteTable
 
-	return nil
+	return true, nil
 }
 
 func (s *Server) mergeReceived(rt0 *serverpb.RoutingTable, rt1 *serverpb.RoutingTable) (*serverpb.RoutingTable, error) {
@@ -265,21 +455,23 @@ func deleteDuplicates(filters []*serverpb.BloomFilter, maxWidth int) ([]*serverp
 	firstDuplicate := -1
 	lastNonEmpty := 0
 
-	emptyFilter := createNewBloomFilter()
-
 	for i, filter := range filters {
-		var f bloom.BloomFilter
-		if len(filter.Data) > 0 {
-			if err := f.GobDecode(filter.Data); err != nil {
-				return nil, err
+		empty := true
+		for _, slice := range filter.Slices {
+			if slice.Count > 0 {
+				empty = false
+				break
 			}
 		}
-		empty := len(filter.Data) == 0 || f.Equal(emptyFilter)
 		if !empty {
 			lastNonEmpty = i
 		}
 
-		key := string(filter.Data)
+		body, err := filter.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		key := string(body)
 		if !empty && seen[key] {
 			if firstDuplicate <= 0 {
 				firstDuplicate = i
@@ -305,67 +497,34 @@ func deleteDuplicates(filters []*serverpb.BloomFilter, maxWidth int) ([]*serverp
 	return deduped[:firstDuplicate], nil
 }
 
+// mergeFilters returns a filter containing the keys of both filters. The
+// filters may have been sized differently.
 func mergeFilters(bf0 *serverpb.BloomFilter, bf1 *serverpb.BloomFilter) (*serverpb.BloomFilter, error) {
-	if len(bf0.Data) == 0 {
+	if len(bf0.Slices) == 0 {
 		return bf1, nil
 	}
 
-	if len(bf1.Data) == 0 {
+	if len(bf1.Slices) == 0 {
 		return bf0, nil
 	}
 
-	var filter bloom.BloomFilter
-	if err := filter.GobDecode(bf0.Data); err != nil {
-		return nil, err
-	}
-
-	var receivedFilter bloom.BloomFilter
-	if err := receivedFilter.GobDecode(bf1.Data); err != nil {
+	filter, err := decodeFilter(bf0)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := filter.Merge(&receivedFilter); err != nil {
+	receivedFilter, err := decodeFilter(bf1)
+	if err != nil {
 		return nil, err
 	}
 
-	mergedFilter, err := filter.GobEncode()
-	if err != nil {
+	if err := filter.Merge(receivedFilter); err != nil {
 		return nil, err
 	}
 
-	return &serverpb.BloomFilter{Data: mergedFilter}, nil
+	return filter.encode()
 }
 
 func (s *Server) loadRoutingTable() error {
-	if err := s.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		{
-			prefix := []byte("/document/")
-			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-				item := it.Item()
-				id := path.Base(string(item.Key()))
-				if err := s.addToRoutingTable(id); err != nil {
-					return err
-				}
-			}
-		}
-
-		{
-			prefix := []byte("/reference/")
-			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-				item := it.Item()
-				id := path.Base(string(item.Key()))
-				if err := s.addToRoutingTable(id); err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	}); err != nil {
-		return err
-	}
-
-	return nil
+	return s.rebuildRoutingTable()
 }
@@ -1,23 +1,30 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 	"reflect"
 	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/willf/bloom"
 )
 
 func filter(t *testing.T, msg ...string) *serverpb.BloomFilter {
-	filter := createNewBloomFilter()
+	filter := newScalableFilter(0)
 	for _, m := range msg {
 		filter.AddString(m)
 	}
 
-	mergedFilter, err := filter.GobEncode()
+	bf, err := filter.encode()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	return &serverpb.BloomFilter{Data: mergedFilter}
+	return bf
 }
 
 func TestDeleteDuplicates(t *testing.T) {
@@ -98,3 +105,238 @@ func TestDeleteDuplicates(t *testing.T) {
 		}
 	}
 }
+
+func TestRebuildRoutingTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	resp, err := s.Add(context.Background(), &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: []byte("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	documentID, _, err := SplitAccessID(resp.AccessId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CheckNumHopsToGetToFile(documentID); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("/document/" + documentID))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.invalidateRoutingTable()
+	if err := s.rebuildRoutingTableIfStale(); err != nil {
+		t.Fatal(err)
+	}
+
+	if hops, err := s.CheckNumHopsToGetToFile(documentID); err == nil {
+		t.Fatalf("expected deleted document to be removed; found at %d hops", hops)
+	}
+}
+
+func TestScalableFilter(t *testing.T) {
+	small := newScalableFilter(0)
+	for i := 0; i < 3*minFilterKeys; i++ {
+		small.AddString(fmt.Sprintf("small %d", i))
+	}
+	if len(small.slices) < 2 {
+		t.Fatalf("expected filter to grow; got %d slices", len(small.slices))
+	}
+	if rate := small.FalsePositiveRate(); rate > FalsePositiveProbability {
+		t.Fatalf("false positive rate too high: %f", rate)
+	}
+
+	large := newScalableFilter(100000)
+	large.AddString("large")
+
+	if err := large.Merge(small); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*minFilterKeys; i++ {
+		if !large.TestString(fmt.Sprintf("small %d", i)) {
+			t.Fatalf("merged filter missing key %d", i)
+		}
+	}
+	if !large.TestString("large") {
+		t.Fatal("merged filter missing original key")
+	}
+	if got, want := large.Count(), uint64(3*minFilterKeys+1); got != want {
+		t.Fatalf("Count() = %d; want %d", got, want)
+	}
+}
+
+func TestFilterSliceEncoding(t *testing.T) {
+	// Bits 3 and 63 of the first word and bit 0 of the second.
+	orig := newFilterSliceFrom([]uint64{1<<3 | 1<<63, 1}, 3)
+	slice := encodeSlice(orig)
+	if slice.M != 128 || slice.K != 3 || slice.Version != filterVersion || slice.HashScheme != filterHashScheme {
+		t.Fatalf("unexpected slice parameters %+v", slice)
+	}
+	want := make([]byte, 16)
+	want[0] = 0x08
+	want[7] = 0x80
+	want[8] = 0x01
+	if !reflect.DeepEqual(slice.Bits, want) {
+		t.Fatalf("got bits %x; wanted %x", slice.Bits, want)
+	}
+
+	decoded, err := decodeSlice(slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.filter.Equal(bloom.From([]uint64{1<<3 | 1<<63, 1}, 3)) {
+		t.Fatal("decoded filter doesn't match original")
+	}
+
+	// Keys must still be found after a round trip.
+	f := newFilterSlice(100, 0)
+	f.filter.AddString("a")
+	decoded, err = decodeSlice(encodeSlice(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.filter.TestString("a") {
+		t.Fatal("expected round tripped filter to contain a")
+	}
+
+	for _, mutate := range []func(*serverpb.BloomFilterSlice){
+		func(s *serverpb.BloomFilterSlice) { s.Version = filterVersion + 1 },
+		func(s *serverpb.BloomFilterSlice) { s.K = maxFilterK + 1 },
+		func(s *serverpb.BloomFilterSlice) { s.M = 100 },
+		func(s *serverpb.BloomFilterSlice) { s.Bits = s.Bits[1:] },
+	} {
+		bad := encodeSlice(orig)
+		mutate(bad)
+		if _, err := decodeSlice(bad); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestRoutingTableVersionStable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Each pair of peer filters overflows a slice, so merging in a different
+	// order combines different slices.
+	s.mu.Lock()
+	for i := 0; i < 8; i++ {
+		f := newScalableFilter(0)
+		for j := 0; j < minFilterKeys*2/3; j++ {
+			f.AddString(fmt.Sprintf("%d-%d", i, j))
+		}
+		bf, err := f.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("peer%d", i)
+		s.mu.peers[id] = &peer{
+			meta:         serverpb.NodeMeta{Id: id},
+			routingTable: &serverpb.RoutingTable{Filters: []*serverpb.BloomFilter{bf}},
+		}
+	}
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	first, err := s.GetRoutingTable(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		rt, err := s.GetRoutingTable(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rt.Version != first.Version {
+			t.Fatalf("version of unchanged table changed from %s to %s", first.Version, rt.Version)
+		}
+	}
+}
+
+func TestRoutingTableUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	rt, err := s.GetRoutingTable(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Unchanged || rt.Version == "" {
+		t.Fatalf("expected a full table with a version; got %+v", rt)
+	}
+
+	same, err := s.GetRoutingTable(ctx, &serverpb.RoutingTable{Version: rt.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Unchanged || same.Version != rt.Version || len(same.Filters) > 0 {
+		t.Fatalf("expected an unchanged response with version %s; got %+v", rt.Version, same)
+	}
+
+	if err := s.addToRoutingTable("a"); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := s.GetRoutingTable(ctx, &serverpb.RoutingTable{Version: rt.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Unchanged || changed.Version == rt.Version || len(changed.Filters) == 0 {
+		t.Fatalf("expected a new table after an add; got %+v", changed)
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	max := routingTableMaxBackoff * RoutingTableInterval
+
+	interval := RoutingTableInterval
+	for i := 0; i < 2; i++ {
+		interval = nextPollInterval(interval, false)
+	}
+	if interval != 4*RoutingTableInterval {
+		t.Fatalf("expected interval to double twice; got %s", interval)
+	}
+	for i := 0; i < 5; i++ {
+		interval = nextPollInterval(interval, false)
+	}
+	if interval != max {
+		t.Fatalf("expected interval to stop at %s; got %s", max, interval)
+	}
+	if interval = nextPollInterval(interval, true); interval != RoutingTableInterval {
+		t.Fatalf("expected a change to reset the interval; got %s", interval)
+	}
+}
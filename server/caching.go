@@ -123,7 +123,7 @@ func (s *Server) cacheEvict() (int64, error) {
 		}
 	}
 
-	if err := s.db.View(func(txn *badger.Txn) error {
+	if err := s.db.Update(func(txn *badger.Txn) error {
 		err := txn.Delete(oldestItem.key)
 		if err != nil {
 			return err
@@ -137,7 +137,7 @@ func (s *Server) cacheEvict() (int64, error) {
 	prefix := []byte("/document/")
 
 	docKey := []byte(fmt.Sprintf("%s%s", prefix, docId))
-	if err := s.db.View(func(txn *badger.Txn) error {
+	if err := s.db.Update(func(txn *badger.Txn) error {
 		err := txn.Delete(docKey)
 		if err != nil {
 			return err
@@ -146,6 +146,7 @@ func (s *Server) cacheEvict() (int64, error) {
 	}); err != nil {
 		return 0, err
 	}
+	s.invalidateRoutingTable()
 
 	return oldestItem.value.Sizeofdoc, nil
 }
@@ -29,7 +29,19 @@ func SplitAccessID(id string) (string, []byte, error) {
 }
 
 func (s *Server) Get(ctx context.Context, in *serverpb.GetRequest) (*serverpb.GetResponse, error) {
-	documentId, accessKey, err := SplitAccessID(in.GetAccessId())
+	resp, err := s.getDocument(ctx, in.GetAccessId())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Document.GetContentType() == "directory" {
+		s.prefetchDirectory(in.GetAccessId(), resp.Document)
+	}
+	return resp, nil
+}
+
+// getDocument fetches and decrypts the document.
+func (s *Server) getDocument(ctx context.Context, accessID string) (*serverpb.GetResponse, error) {
+	documentId, accessKey, err := SplitAccessID(accessID)
 	if err != nil {
 		return nil, err
 	}
@@ -75,10 +87,20 @@ func (s *Server) Add(ctx context.Context, in *serverpb.AddRequest) (*serverpb.Ad
 		AccessId: accessId,
 	}
 
-	if err := s.addToRoutingTable(hash); err != nil {
+	if err := s.router.Provide(ctx, hash); err != nil {
 		return nil, err
 	}
 
+	replication := in.GetReplication()
+	if replication == 0 {
+		replication = s.config.Replication
+	}
+	if replication > 0 {
+		// Pushing to peers can take a while and shouldn't be cut short if
+		// the client goes away, so it runs on the server's context.
+		go s.replicate(s.ctx, hash, encryptedDocument, replication)
+	}
+
 	return resp, nil
 }
 
@@ -89,20 +111,50 @@ func (s *Server) AddDirectory(ctx context.Context, in *serverpb.AddDirectoryRequ
 
 func (s *Server) GetPeers(ctx context.Context, in *serverpb.GetPeersRequest) (*serverpb.GetPeersResponse, error) {
 	var peers []*serverpb.NodeMeta
+	var stats []*serverpb.PeerStats
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, v := range s.mu.peerMeta {
+		v := v
 		peers = append(peers, &v)
 	}
+	for _, p := range s.mu.peers {
+		stats = append(stats, p.statsPB())
+	}
 
 	resp := &serverpb.GetPeersResponse{
 		Peers: peers,
+		Stats: stats,
 	}
 
 	return resp, nil
 }
 
+// GetStats returns statistics about the node's routing table.
+func (s *Server) GetStats(ctx context.Context, in *serverpb.GetStatsRequest) (*serverpb.GetStatsResponse, error) {
+	rt, err := s.GetRoutingTable(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &serverpb.GetStatsResponse{}
+	for i, bf := range rt.Filters {
+		filter, err := decodeFilter(bf)
+		if err != nil {
+			return nil, err
+		}
+		resp.Filters = append(resp.Filters, &serverpb.FilterStats{
+			Hops:              int32(i),
+			Keys:              filter.Count(),
+			Bits:              filter.Bits(),
+			Slices:            int32(len(filter.slices)),
+			FalsePositiveRate: filter.FalsePositiveRate(),
+		})
+	}
+	return resp, nil
+}
+
 func (s *Server) AddPeer(ctx context.Context, in *serverpb.AddPeerRequest) (*serverpb.AddPeerResponse, error) {
 	err := s.BootstrapAddNode(ctx, in.GetAddr())
 	if err != nil {
@@ -126,7 +178,8 @@ func (s *Server) GetReference(ctx context.Context, in *serverpb.GetReferenceRequ
 		return nil, err
 	}
 
-	reference := resp.GetReference()
+	// Copy the reference since the response may be shared with other callers.
+	reference := *resp.GetReference()
 	value, err := DecryptBytes(accessKey, []byte(reference.GetValue()))
 	if err != nil {
 		return nil, err
@@ -134,7 +187,7 @@ func (s *Server) GetReference(ctx context.Context, in *serverpb.GetReferenceRequ
 	reference.Value = string(value)
 
 	return &serverpb.GetReferenceResponse{
-		Reference: reference,
+		Reference: &reference,
 	}, nil
 }
 
@@ -194,7 +247,7 @@ func (s *Server) AddReference(ctx context.Context, in *serverpb.AddReferenceRequ
 		return nil, err
 	}
 
-	if err := s.addToRoutingTable(referenceId); err != nil {
+	if err := s.router.Provide(ctx, referenceId); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+)
+
+// flight is a fetch shared between concurrent callers.
+type flight struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// coalesce calls fn once for concurrent callers with the same key and gives
+// them all its result. Each caller waits only until its own context is done,
+// so its deadline still applies. fn runs with its own context, which is
+// cancelled once every caller waiting on it has given up.
+//
+// Only requests that started on this node should be coalesced. Relayed
+// requests waiting on each other across nodes could otherwise deadlock.
+func (s *Server) coalesce(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	f, ok := s.mu.flights[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(s.ctx)
+		f = &flight{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		s.mu.flights[key] = f
+
+		go func() {
+			f.val, f.err = fn(fctx)
+			cancel()
+
+			s.mu.Lock()
+			if s.mu.flights[key] == f {
+				delete(s.mu.flights, key)
+			}
+			s.mu.Unlock()
+
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			// Later callers start a new fetch rather than joining a cancelled one.
+			if s.mu.flights[key] == f {
+				delete(s.mu.flights, key)
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const callers = 50
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "body", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := s.coalesce(context.Background(), "/document/a", fn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if v != "body" {
+				t.Errorf("got %v; wanted body", v)
+			}
+		}()
+	}
+
+	// Wait for every caller to join the flight before letting it finish.
+	for {
+		s.mu.Lock()
+		f := s.mu.flights["/document/a"]
+		joined := f != nil && f.waiters == callers
+		s.mu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected 1 fetch; got %d", calls)
+	}
+
+	// A caller whose deadline passes gives up without cancelling the fetch for
+	// the callers still waiting.
+	release = make(chan struct{})
+	calls = 0
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.coalesce(context.Background(), "/document/c", fn)
+		result <- err
+	}()
+	for {
+		s.mu.Lock()
+		started := s.mu.flights["/document/c"] != nil
+		s.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	if _, err := s.coalesce(short, "/document/c", fn); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded; got %+v", err)
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatalf("expected waiting caller to get the result; got %+v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 fetch; got %d", calls)
+	}
+
+	// The fetch is cancelled once every caller has given up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan struct{})
+	cancel()
+	if _, err := s.coalesce(ctx, "/document/b", func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled; got %+v", err)
+	}
+	<-cancelled
+}
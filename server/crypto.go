@@ -18,8 +18,8 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
+	"net"
 	"os"
 	"time"
 
@@ -111,15 +111,22 @@ func (s *Server) loadCert() error {
 		return err
 	}
 
-	return ErrUnimplemented
+	return nil
 }
 
 func (s *Server) generateCert() error {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		log.Fatalf("failed to generate private key: %s", err)
+		return errors.Wrap(err, "failed to generate private key")
 	}
 	s.key = priv
+	return s.issueCert()
+}
+
+// issueCert creates and stores a self signed certificate for the node's key
+// that's valid for all of the node's hosts.
+func (s *Server) issueCert() error {
+	priv := s.key
 	privKey, err := x509.MarshalECPrivateKey(priv)
 	if err != nil {
 		return err
@@ -131,7 +138,7 @@ func (s *Server) generateCert() error {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
+		return errors.Wrap(err, "failed to generate serial number")
 	}
 
 	template := x509.Certificate{
@@ -143,11 +150,21 @@ func (s *Server) generateCert() error {
 		NotAfter:  notAfter,
 
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 	}
 
-	template.IPAddresses = append(template.IPAddresses, getOutboundIP())
+	hosts, err := s.certHosts()
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
 	if err != nil {
@@ -184,9 +201,23 @@ func (s *Server) generateCert() error {
 
 func (s *Server) loadOrGenerateCert() error {
 	if err := s.loadCert(); err == badger.ErrKeyNotFound {
-		if err := s.generateCert(); err != nil {
-			return err
-		}
+		return s.generateCert()
+	} else if err != nil {
+		return err
+	}
+
+	// Reissue the certificate with the same key if the node's addresses have
+	// changed since it was issued.
+	cert, err := x509.ParseCertificate(s.cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	hosts, err := s.certHosts()
+	if err != nil {
+		return err
+	}
+	if !certCovers(cert, hosts) {
+		return s.issueCert()
 	}
 	return nil
 }
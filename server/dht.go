@@ -0,0 +1,614 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"path"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+const (
+	// dhtK is the number of nodes provider records are stored on.
+	dhtK = 20
+	// dhtAlpha is the number of nodes queried per lookup round.
+	dhtAlpha = 3
+	// dhtRepublishMultiple is how many RoutingTableIntervals pass between
+	// republishing the local provider records.
+	dhtRepublishMultiple = 10
+	// dhtRecordTTLMultiple is how many republish intervals a provider record
+	// lives for without being refreshed.
+	dhtRecordTTLMultiple = 3
+	// dhtProvideWorkers is how many keys are announced to the DHT at once.
+	dhtProvideWorkers = dhtAlpha
+)
+
+var ErrNotDHT = errors.New("node isn't using the kademlia router")
+
+type providerRecord struct {
+	meta    serverpb.NodeMeta
+	expires time.Time
+}
+
+// dhtRouter is a Kademlia style DHT. Node IDs and content IDs share the same
+// 160 bit key space and provider records for a content ID are stored on the
+// dhtK nodes closest to it by XOR distance.
+type dhtRouter struct {
+	s *Server
+
+	mu struct {
+		sync.Mutex
+
+		// providers maps content ID to provider node ID to record.
+		providers map[string]map[string]providerRecord
+		// conns are connections to nodes that aren't peers.
+		conns map[string]*grpc.ClientConn
+		// queue holds the keys waiting to be announced and queued the same
+		// keys so each is only queued once.
+		queue  []string
+		queued map[string]bool
+	}
+
+	// wake is signalled when keys are queued.
+	wake chan struct{}
+}
+
+func newDHTRouter(s *Server) *dhtRouter {
+	d := &dhtRouter{
+		s:    s,
+		wake: make(chan struct{}, 1),
+	}
+	d.mu.providers = map[string]map[string]providerRecord{}
+	d.mu.conns = map[string]*grpc.ClientConn{}
+	d.mu.queued = map[string]bool{}
+	return d
+}
+
+func dhtKey(id string) ([]byte, error) {
+	key, err := base64.URLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %q", id)
+	}
+	return key, nil
+}
+
+// dhtCloser returns whether a is closer to key than b by XOR distance.
+func dhtCloser(key, a, b []byte) bool {
+	for i := range key {
+		var da, db byte
+		if i < len(a) {
+			da = a[i] ^ key[i]
+		}
+		if i < len(b) {
+			db = b[i] ^ key[i]
+		}
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+func sortByDistance(key []byte, metas []serverpb.NodeMeta) {
+	ids := make(map[string][]byte, len(metas))
+	for _, meta := range metas {
+		ids[meta.Id], _ = dhtKey(meta.Id)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return dhtCloser(key, ids[metas[i].Id], ids[metas[j].Id])
+	})
+}
+
+// closestKnown returns the n known nodes closest to key, excluding the local
+// node.
+func (d *dhtRouter) closestKnown(key []byte, n int) []serverpb.NodeMeta {
+	d.s.mu.Lock()
+	var metas []serverpb.NodeMeta
+	for _, meta := range d.s.mu.peerMeta {
+		metas = append(metas, meta)
+	}
+	d.s.mu.Unlock()
+
+	sortByDistance(key, metas)
+	if len(metas) > n {
+		metas = metas[:n]
+	}
+	return metas
+}
+
+// client returns a client for the node, reusing peer connections if possible.
+func (d *dhtRouter) client(ctx context.Context, meta serverpb.NodeMeta) (serverpb.NodeClient, error) {
+	d.s.mu.Lock()
+	peer, ok := d.s.mu.peers[meta.Id]
+	d.s.mu.Unlock()
+	if ok {
+		return peer.client, nil
+	}
+
+	d.mu.Lock()
+	conn, ok := d.mu.conns[meta.Id]
+	d.mu.Unlock()
+	if ok {
+		return serverpb.NewNodeClient(conn), nil
+	}
+
+	conn, err := d.s.connectNode(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if existing, ok := d.mu.conns[meta.Id]; ok {
+		conn.Close()
+		conn = existing
+	} else {
+		d.mu.conns[meta.Id] = conn
+	}
+	return serverpb.NewNodeClient(conn), nil
+}
+
+func (d *dhtRouter) dropClient(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if conn, ok := d.mu.conns[id]; ok {
+		conn.Close()
+		delete(d.mu.conns, id)
+	}
+}
+
+// pruneConns closes connections to nodes that have been forgotten or
+// blocked, or that are now peers and have a connection of their own.
+func (d *dhtRouter) pruneConns() {
+	d.mu.Lock()
+	var ids []string
+	for id := range d.mu.conns {
+		ids = append(ids, id)
+	}
+	d.mu.Unlock()
+
+	var stale []string
+	d.s.mu.Lock()
+	for _, id := range ids {
+		_, known := d.s.mu.peerMeta[id]
+		_, peer := d.s.mu.peers[id]
+		if !known || peer || d.s.blockedIDLocked(id) {
+			stale = append(stale, id)
+		}
+	}
+	d.s.mu.Unlock()
+
+	for _, id := range stale {
+		d.dropClient(id)
+	}
+}
+
+// learn records nodes returned by other nodes as contacts.
+func (d *dhtRouter) learn(localID string, metas []*serverpb.NodeMeta) []serverpb.NodeMeta {
+	var learned []serverpb.NodeMeta
+	for _, meta := range metas {
+		if meta == nil || meta.Id == localID {
+			continue
+		}
+		if err := validateNodeMeta(*meta); err != nil {
+			d.s.log.Printf("dht: invalid node meta: %+v", err)
+			continue
+		}
+		d.s.addNodeMeta(*meta)
+		learned = append(learned, *meta)
+	}
+	return learned
+}
+
+// lookup iteratively queries the nodes closest to key. If findProviders is
+// set, it stops as soon as any providers are found.
+func (d *dhtRouter) lookup(ctx context.Context, key []byte, findProviders bool) ([]serverpb.NodeMeta, []serverpb.NodeMeta, error) {
+	localID, err := d.s.getLocalId()
+	if err != nil {
+		return nil, nil, err
+	}
+	id := base64.URLEncoding.EncodeToString(key)
+
+	shortlist := d.closestKnown(key, dhtK)
+	seen := map[string]bool{}
+	for _, meta := range shortlist {
+		seen[meta.Id] = true
+	}
+	queried := map[string]bool{}
+	var providers []serverpb.NodeMeta
+	seenProviders := map[string]bool{}
+
+	for {
+		var round []serverpb.NodeMeta
+		for _, meta := range shortlist {
+			if len(round) >= dhtAlpha {
+				break
+			}
+			if !queried[meta.Id] {
+				round = append(round, meta)
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		for _, meta := range round {
+			queried[meta.Id] = true
+
+			client, err := d.client(ctx, meta)
+			if err != nil {
+				d.s.log.Printf("dht: dialing %s: %+v", color.RedString(meta.Id), err)
+				continue
+			}
+			var found, closer []*serverpb.NodeMeta
+			if findProviders {
+				resp, err := client.GetProviders(ctx, &serverpb.GetProvidersRequest{
+					Key: id,
+				})
+				if err != nil {
+					d.s.log.Printf("dht: GetProviders %s: %+v", color.RedString(meta.Id), err)
+					d.dropClient(meta.Id)
+					continue
+				}
+				found, closer = resp.Providers, resp.Closer
+			} else {
+				resp, err := client.FindNode(ctx, &serverpb.FindNodeRequest{
+					Key: id,
+				})
+				if err != nil {
+					d.s.log.Printf("dht: FindNode %s: %+v", color.RedString(meta.Id), err)
+					d.dropClient(meta.Id)
+					continue
+				}
+				closer = resp.Closer
+			}
+			for _, provider := range d.learn(localID, found) {
+				if !seenProviders[provider.Id] {
+					seenProviders[provider.Id] = true
+					providers = append(providers, provider)
+				}
+			}
+			for _, closer := range d.learn(localID, closer) {
+				if !seen[closer.Id] {
+					seen[closer.Id] = true
+					shortlist = append(shortlist, closer)
+				}
+			}
+		}
+
+		if findProviders && len(providers) > 0 {
+			break
+		}
+		sortByDistance(key, shortlist)
+		if len(shortlist) > dhtK {
+			shortlist = shortlist[:dhtK]
+		}
+	}
+
+	return shortlist, providers, nil
+}
+
+func (d *dhtRouter) addProvider(id string, meta serverpb.NodeMeta) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	records, ok := d.mu.providers[id]
+	if !ok {
+		records = map[string]providerRecord{}
+		d.mu.providers[id] = records
+	}
+	records[meta.Id] = providerRecord{
+		meta:    meta,
+		expires: time.Now().Add(dhtRecordTTLMultiple * dhtRepublishMultiple * RoutingTableInterval),
+	}
+}
+
+func (d *dhtRouter) localProviders(id string) []serverpb.NodeMeta {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	var metas []serverpb.NodeMeta
+	for nodeID, record := range d.mu.providers[id] {
+		if now.After(record.expires) {
+			delete(d.mu.providers[id], nodeID)
+			continue
+		}
+		metas = append(metas, record.meta)
+	}
+	return metas
+}
+
+// Provide records the local node as a provider of id and queues it to be
+// announced to the nodes closest to it, so callers don't wait on the lookup.
+func (d *dhtRouter) Provide(ctx context.Context, id string) error {
+	if _, err := dhtKey(id); err != nil {
+		return err
+	}
+	meta, err := d.s.NodeMeta()
+	if err != nil {
+		return err
+	}
+	d.addProvider(id, meta)
+	d.enqueue(id)
+	return nil
+}
+
+func (d *dhtRouter) enqueue(ids ...string) {
+	d.mu.Lock()
+	for _, id := range ids {
+		if d.mu.queued[id] {
+			continue
+		}
+		d.mu.queued[id] = true
+		d.mu.queue = append(d.mu.queue, id)
+	}
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dhtRouter) dequeue() (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.mu.queue) == 0 {
+		return "", false
+	}
+	id := d.mu.queue[0]
+	d.mu.queue = d.mu.queue[1:]
+	delete(d.mu.queued, id)
+	return id, true
+}
+
+// announceQueued announces queued keys until the server is closed.
+func (d *dhtRouter) announceQueued() {
+	for {
+		id, ok := d.dequeue()
+		if !ok {
+			select {
+			case <-d.wake:
+			case <-d.s.ctx.Done():
+				return
+			}
+			continue
+		}
+		if err := d.announce(d.s.ctx, id); err != nil {
+			d.s.log.Printf("dht: announcing %s: %+v", id, err)
+		}
+	}
+}
+
+// announce stores a provider record for id on the nodes closest to it.
+func (d *dhtRouter) announce(ctx context.Context, id string) error {
+	key, err := dhtKey(id)
+	if err != nil {
+		return err
+	}
+	meta, err := d.s.NodeMeta()
+	if err != nil {
+		return err
+	}
+
+	closest, _, err := d.lookup(ctx, key, false)
+	if err != nil {
+		return err
+	}
+	for _, node := range closest {
+		client, err := d.client(ctx, node)
+		if err != nil {
+			d.s.log.Printf("dht: dialing %s: %+v", color.RedString(node.Id), err)
+			continue
+		}
+		if _, err := client.AddProvider(ctx, &serverpb.AddProviderRequest{
+			Key:      id,
+			Provider: &meta,
+		}); err != nil {
+			d.s.log.Printf("dht: AddProvider %s: %+v", color.RedString(node.Id), err)
+			d.dropClient(node.Id)
+		}
+	}
+	return nil
+}
+
+func (d *dhtRouter) FindProviders(ctx context.Context, id string) ([]Route, error) {
+	key, err := dhtKey(id)
+	if err != nil {
+		return nil, err
+	}
+	localID, err := d.s.getLocalId()
+	if err != nil {
+		return nil, err
+	}
+
+	providers := d.localProviders(id)
+	if len(providers) == 0 || (len(providers) == 1 && providers[0].Id == localID) {
+		_, found, err := d.lookup(ctx, key, true)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, found...)
+	}
+
+	var routes []Route
+	seen := map[string]bool{}
+	for _, meta := range providers {
+		if meta.Id == localID || seen[meta.Id] {
+			continue
+		}
+		seen[meta.Id] = true
+		client, err := d.client(ctx, meta)
+		if err != nil {
+			d.s.log.Printf("dht: dialing provider %s: %+v", color.RedString(meta.Id), err)
+			continue
+		}
+		routes = append(routes, Route{
+			ID:      meta.Id,
+			Addrs:   meta.Addrs,
+			Client:  client,
+			NumHops: 1,
+		})
+	}
+	// Provider records are only stored by the nodes holding the key, so a
+	// previous failed lookup is out of date.
+	if len(routes) > 0 {
+		d.s.forgetNotFound(id)
+	}
+	return routes, nil
+}
+
+// Run announces the local documents and references, starting with those
+// already stored, and republishes them until the server is closed.
+func (d *dhtRouter) Run() {
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		for id, conn := range d.mu.conns {
+			conn.Close()
+			delete(d.mu.conns, id)
+		}
+	}()
+
+	for i := 0; i < dhtProvideWorkers; i++ {
+		go d.announceQueued()
+	}
+
+	// The first republish only waits for the node to connect to its peers, so
+	// content stored before a restart is announced straight away.
+	wait := RoutingTableInterval
+	for {
+		select {
+		case <-time.After(wait):
+		case <-d.s.ctx.Done():
+			return
+		}
+		wait = dhtRepublishMultiple * RoutingTableInterval
+
+		d.pruneConns()
+		if err := d.republish(); err != nil {
+			d.s.log.Printf("dht: republish error: %+v", err)
+		}
+	}
+}
+
+// republish refreshes the local provider records and queues every local
+// document and reference to be announced again.
+func (d *dhtRouter) republish() error {
+	var ids []string
+	if err := d.s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for _, prefix := range [][]byte{[]byte("/document/"), []byte("/reference/")} {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				ids = append(ids, path.Base(string(it.Item().Key())))
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	meta, err := d.s.NodeMeta()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		d.addProvider(id, meta)
+	}
+	d.enqueue(ids...)
+	return nil
+}
+
+func (s *Server) dht() (*dhtRouter, error) {
+	d, ok := s.router.(*dhtRouter)
+	if !ok {
+		return nil, ErrNotDHT
+	}
+	return d, nil
+}
+
+// FindNode returns the known nodes closest to the key.
+func (s *Server) FindNode(ctx context.Context, req *serverpb.FindNodeRequest) (*serverpb.FindNodeResponse, error) {
+	d, err := s.dht()
+	if err != nil {
+		return nil, err
+	}
+	key, err := dhtKey(req.GetKey())
+	if err != nil {
+		return nil, err
+	}
+
+	var resp serverpb.FindNodeResponse
+	for _, meta := range d.closestKnown(key, dhtK) {
+		meta := meta
+		resp.Closer = append(resp.Closer, &meta)
+	}
+	return &resp, nil
+}
+
+// AddProvider stores a provider record for the key.
+func (s *Server) AddProvider(ctx context.Context, req *serverpb.AddProviderRequest) (*serverpb.AddProviderResponse, error) {
+	d, err := s.dht()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dhtKey(req.GetKey()); err != nil {
+		return nil, err
+	}
+	provider := req.GetProvider()
+	if provider == nil {
+		return nil, errors.Errorf("Provider field required")
+	}
+	if err := validateNodeMeta(*provider); err != nil {
+		return nil, err
+	}
+	// Nodes can only announce themselves as providers.
+	if err := checkCaller(ctx, provider.Id); err != nil {
+		return nil, err
+	}
+
+	s.addNodeMeta(*provider)
+	d.addProvider(req.GetKey(), *provider)
+	// The key may have been looked up here before the record arrived.
+	s.forgetNotFound(req.GetKey())
+	return &serverpb.AddProviderResponse{}, nil
+}
+
+// GetProviders returns the stored providers for the key and the known nodes
+// closest to it.
+func (s *Server) GetProviders(ctx context.Context, req *serverpb.GetProvidersRequest) (*serverpb.GetProvidersResponse, error) {
+	d, err := s.dht()
+	if err != nil {
+		return nil, err
+	}
+	key, err := dhtKey(req.GetKey())
+	if err != nil {
+		return nil, err
+	}
+
+	var resp serverpb.GetProvidersResponse
+	for _, meta := range d.localProviders(req.GetKey()) {
+		meta := meta
+		resp.Providers = append(resp.Providers, &meta)
+	}
+	for _, meta := range d.closestKnown(key, dhtK) {
+		meta := meta
+		resp.Closer = append(resp.Closer, &meta)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+// DefaultDiscoveryAddr is the multicast group nodes announce themselves on
+// when LAN discovery is enabled without picking a group.
+const DefaultDiscoveryAddr = "239.255.77.1:7171"
+
+var (
+	// DiscoveryInterval is how often nodes announce themselves on the LAN.
+	DiscoveryInterval = 5 * time.Second
+)
+
+const (
+	// announcementMagic prefixes announcements so stray packets on the group
+	// are ignored.
+	announcementMagic = "ipfs-announce/1\n"
+	// maxAnnouncementSize is the largest announcement that will be read.
+	maxAnnouncementSize = 64 * 1024
+)
+
+func encodeAnnouncement(meta serverpb.NodeMeta) ([]byte, error) {
+	body, err := meta.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(announcementMagic), body...), nil
+}
+
+func decodeAnnouncement(packet []byte) (serverpb.NodeMeta, error) {
+	if !bytes.HasPrefix(packet, []byte(announcementMagic)) {
+		return serverpb.NodeMeta{}, errors.Errorf("not an announcement")
+	}
+	var meta serverpb.NodeMeta
+	if err := meta.Unmarshal(packet[len(announcementMagic):]); err != nil {
+		return serverpb.NodeMeta{}, err
+	}
+	if err := validateNodeMeta(meta); err != nil {
+		return serverpb.NodeMeta{}, err
+	}
+	return meta, nil
+}
+
+// discover announces the node on the LAN and connects to nodes announcing
+// themselves until the server is closed.
+func (s *Server) discover() {
+	addr, err := net.ResolveUDPAddr("udp4", s.config.DiscoveryAddr)
+	if err != nil {
+		s.log.Printf("discovery error: %+v", err)
+		return
+	}
+
+	go s.announce(addr)
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		s.log.Printf("discovery listen error: %+v", err)
+		return
+	}
+	go func() {
+		<-s.ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.log.Printf("discovery read error: %+v", err)
+			continue
+		}
+		s.handleAnnouncement(buf[:n], from)
+	}
+}
+
+// handleAnnouncement connects to the node in the announcement if it's a new
+// node and there are free connection slots.
+func (s *Server) handleAnnouncement(packet []byte, from *net.UDPAddr) {
+	meta, err := decodeAnnouncement(packet)
+	if err != nil {
+		s.log.Printf("ignoring announcement from %s: %+v", from, err)
+		return
+	}
+
+	localID, err := s.getLocalId()
+	if err != nil {
+		s.log.Printf("discovery error: %+v", err)
+		return
+	}
+	if meta.Id == localID {
+		return
+	}
+	s.mu.Lock()
+	_, connected := s.mu.peers[meta.Id]
+	s.mu.Unlock()
+	if connected {
+		return
+	}
+
+	s.log.Printf("discovered %s at %s", color.RedString(meta.Id), from)
+	go func() {
+		if err := s.AddNode(meta, false); err != nil {
+			s.log.Printf("failed to add discovered node: %+v", err)
+		}
+	}()
+}
+
+// announce periodically sends the node's NodeMeta to the multicast group.
+func (s *Server) announce(addr *net.UDPAddr) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		s.log.Printf("discovery announce error: %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		meta, err := s.NodeMeta()
+		if err != nil {
+			s.log.Printf("discovery announce error: %+v", err)
+		} else if len(meta.Addrs) > 0 {
+			packet, err := encodeAnnouncement(meta)
+			if err != nil {
+				s.log.Printf("discovery announce error: %+v", err)
+			} else if _, err := conn.Write(packet); err != nil {
+				s.log.Printf("discovery announce error: %+v", err)
+			}
+		}
+
+		select {
+		case <-time.After(DiscoveryInterval):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestAnnouncement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	meta, err := s.NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Addrs = []string{"192.0.2.1:8181"}
+	meta.Signature = ""
+	meta.Signature, err = nodeMetaSign(meta, s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := encodeAnnouncement(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeAnnouncement(packet)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got.Id != meta.Id || len(got.Addrs) != 1 || got.Addrs[0] != meta.Addrs[0] {
+		t.Errorf("decoded %+v; expected %+v", got, meta)
+	}
+
+	if _, err := decodeAnnouncement(packet[len(announcementMagic):]); err == nil {
+		t.Error("expected packet without the magic prefix to be ignored")
+	}
+
+	// Announcements with forged addresses fail the signature check.
+	forged := meta
+	forged.Addrs = []string{"192.0.2.2:8181"}
+	packet, err = encodeAnnouncement(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeAnnouncement(packet); err == nil {
+		t.Error("expected forged announcement to be rejected")
+	}
+}
+
+func TestRememberNodeMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: filepath.Join(dir, "s")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	o, err := New(serverpb.NodeConfig{Path: filepath.Join(dir, "o")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	signed := func(updated int64, addr string) serverpb.NodeMeta {
+		meta, err := o.NodeMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta.Updated = updated
+		meta.Addrs = []string{addr}
+		meta.Signature = ""
+		meta.Signature, err = nodeMetaSign(meta, o.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	persisted := func(id string) int64 {
+		var meta serverpb.NodeMeta
+		if err := s.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(fmt.Sprintf("/NodeMeta/%s", id)))
+			if err != nil {
+				return err
+			}
+			body, err := item.Value()
+			if err != nil {
+				return err
+			}
+			return meta.Unmarshal(body)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return meta.Updated
+	}
+
+	for i, c := range []struct {
+		meta      serverpb.NodeMeta
+		new       bool
+		persisted int64
+	}{
+		{signed(1, "192.0.2.1:8181"), true, 1},
+		// Repeated announcements with the same addresses aren't written.
+		{signed(2, "192.0.2.1:8181"), false, 1},
+		{signed(3, "192.0.2.2:8181"), false, 3},
+		// Older copies are never written.
+		{signed(2, "192.0.2.3:8181"), false, 3},
+	} {
+		new, err := s.rememberNodeMeta(c.meta)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if new != c.new {
+			t.Errorf("%d. new = %t; expected %t", i, new, c.new)
+		}
+		if got := persisted(c.meta.Id); got != c.persisted {
+			t.Errorf("%d. persisted copy from %d; expected %d", i, got, c.persisted)
+		}
+	}
+}
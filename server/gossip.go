@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+var (
+	// GossipInterval is how often the node checks whether its own addresses or
+	// certificate changed and gossips the update to its peers.
+	GossipInterval = 5 * time.Second
+)
+
+// GossipNodeMeta receives NodeMeta updates from a peer, keeps the newer ones
+// and passes those on to the other peers.
+func (s *Server) GossipNodeMeta(ctx context.Context, req *serverpb.GossipNodeMetaRequest) (*serverpb.GossipNodeMetaResponse, error) {
+	localID, err := s.getLocalId()
+	if err != nil {
+		return nil, err
+	}
+	// The interceptor has already checked the caller's certificate.
+	from, err := callerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []*serverpb.NodeMeta
+	for _, meta := range req.GetMetas() {
+		if meta == nil || meta.Id == localID {
+			continue
+		}
+		if err := validateNodeMeta(*meta); err != nil {
+			s.log.Printf("ignoring gossiped meta from %s: %+v", color.RedString(from), err)
+			continue
+		}
+		if _, ok := s.storeNodeMeta(*meta); !ok {
+			continue
+		}
+		if err := s.persistNodeMeta(*meta); err != nil {
+			return nil, err
+		}
+		updated = append(updated, meta)
+	}
+
+	// Only updates are passed on, so gossip stops once every node has the
+	// newest copy.
+	if len(updated) > 0 {
+		go s.gossip(updated, from)
+	}
+
+	return &serverpb.GossipNodeMetaResponse{}, nil
+}
+
+// gossip sends the NodeMeta to every peer except the one it came from.
+func (s *Server) gossip(metas []*serverpb.NodeMeta, from string) {
+	s.mu.Lock()
+	var peers []*peer
+	for id, p := range s.mu.peers {
+		if id != from {
+			peers = append(peers, p)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		ctx, cancel := context.WithTimeout(p.ctx, dialTimeout)
+		_, err := p.client.GossipNodeMeta(ctx, &serverpb.GossipNodeMetaRequest{
+			Metas: metas,
+		})
+		cancel()
+		if err != nil {
+			s.log.Printf("gossip to %s failed: %+v", color.RedString(p.meta.Id), err)
+		}
+	}
+}
+
+// gossipSelf gossips the node's own meta whenever its addresses or
+// certificate change until the server is closed.
+func (s *Server) gossipSelf() {
+	var last serverpb.NodeMeta
+	for {
+		select {
+		case <-time.After(GossipInterval):
+		case <-s.ctx.Done():
+			return
+		}
+
+		meta, err := s.NodeMeta()
+		if err != nil {
+			s.log.Printf("gossip error: %+v", err)
+			continue
+		}
+		if len(meta.Addrs) == 0 || sameContact(last, meta) {
+			continue
+		}
+		last = meta
+		s.gossip([]*serverpb.NodeMeta{&meta}, "")
+	}
+}
+
+// reconnectChanged reconnects to a node whose addresses or certificate
+// changed, since the existing connection was made to the old ones.
+func (s *Server) reconnectChanged(id string) {
+	s.mu.Lock()
+	meta, ok := s.mu.peerMeta[id]
+	p, connected := s.mu.peers[id]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if connected {
+		if sameContact(p.meta, meta) {
+			return
+		}
+		s.log.Printf("addresses of %s changed, reconnecting", color.RedString(id))
+		p.Close()
+	}
+	s.redial(id)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	grpcpeer "google.golang.org/grpc/peer"
+)
+
+func TestGossipNodeMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: filepath.Join(dir, "s")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	o, err := New(serverpb.NodeConfig{Path: filepath.Join(dir, "o")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	cert, err := x509.ParseCertificate(o.cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := grpcpeer.NewContext(context.Background(), &grpcpeer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+		}},
+	})
+
+	signed := func(updated int64, addr string) *serverpb.NodeMeta {
+		meta, err := o.NodeMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta.Updated = updated
+		meta.Addrs = []string{addr}
+		meta.Signature = ""
+		meta.Signature, err = nodeMetaSign(meta, o.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &meta
+	}
+	gossip := func(meta *serverpb.NodeMeta) {
+		if _, err := s.GossipNodeMeta(ctx, &serverpb.GossipNodeMetaRequest{
+			Metas: []*serverpb.NodeMeta{meta},
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	id := signed(1, "192.0.2.1:8181").Id
+	current := func() string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		meta := s.mu.peerMeta[id]
+		if len(meta.Addrs) == 0 {
+			return ""
+		}
+		return meta.Addrs[0]
+	}
+
+	gossip(signed(1, "192.0.2.1:8181"))
+	if got := current(); got != "192.0.2.1:8181" {
+		t.Fatalf("expected gossiped meta to be stored; got %q", got)
+	}
+	gossip(signed(2, "192.0.2.2:8181"))
+	if got := current(); got != "192.0.2.2:8181" {
+		t.Errorf("expected newer meta to replace the old one; got %q", got)
+	}
+	gossip(signed(1, "192.0.2.1:8181"))
+	if got := current(); got != "192.0.2.2:8181" {
+		t.Errorf("expected older meta to be ignored; got %q", got)
+	}
+
+	forged := signed(3, "192.0.2.3:8181")
+	forged.Addrs = []string{"192.0.2.4:8181"}
+	gossip(forged)
+	if got := current(); got != "192.0.2.2:8181" {
+		t.Errorf("expected forged meta to be ignored; got %q", got)
+	}
+}
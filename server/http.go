@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"html"
 	"net/http"
@@ -11,9 +12,11 @@ import (
 	"path/filepath"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/dgraph-io/badger"
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
@@ -21,6 +24,8 @@ func (s *Server) setupHTTP() {
 	s.mux.HandleFunc("/badger/", httpErr(s.httpBadger))
 	s.mux.HandleFunc("/document/", httpErr(s.httpDocument))
 	s.mux.HandleFunc("/subscribe/", httpErr(s.httpSubscribe))
+	s.mux.HandleFunc("/events/", httpErr(s.httpEvents))
+	s.mux.HandleFunc("/ws/", httpErr(s.httpWebSocket))
 	s.mux.HandleFunc("/reference/", httpErr(s.httpReference))
 	s.mux.HandleFunc("/", httpErr(s.httpIndex))
 }
@@ -150,16 +155,26 @@ func (s *Server) httpSubscribe(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	// format=json writes one JSON encoded message per line, including the
+	// payload data, content type and headers.
+	asJSON := r.URL.Query().Get("format") == "json"
+	enc := json.NewEncoder(w)
 	for {
 		msg, err := stream.Recv()
 		if err != nil {
 			return err
 		}
-		if _, err := w.Write([]byte(msg.Message)); err != nil {
-			return err
-		}
-		if _, err := w.Write([]byte("\n")); err != nil {
-			return err
+		if asJSON {
+			if err := enc.Encode(msg); err != nil {
+				return err
+			}
+		} else {
+			if _, err := w.Write([]byte(msg.Message)); err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return err
+			}
 		}
 		if f, ok := w.(http.Flusher); ok {
 			f.Flush()
@@ -168,6 +183,123 @@ func (s *Server) httpSubscribe(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// subscribeRequest returns the subscription to the channel at the end of the
+// request path. The starting point is read from the Last-Event-ID header or
+// the starting query parameter, so reconnecting clients can resume.
+func subscribeRequest(r *http.Request) (*serverpb.SubscribeRequest, error) {
+	starting := r.Header.Get("Last-Event-ID")
+	if starting == "" {
+		starting = r.URL.Query().Get("starting")
+	}
+	req := &serverpb.SubscribeRequest{
+		ChannelId: path.Base(r.URL.Path),
+	}
+	if starting != "" {
+		var err error
+		req.Starting, err = strconv.ParseInt(starting, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid starting point %q", starting)
+		}
+	}
+	return req, nil
+}
+
+// subscribeHTTP starts the subscription described by the request.
+func (s *Server) subscribeHTTP(ctx context.Context, r *http.Request) (serverpb.Client_SubscribeClientClient, error) {
+	req, err := subscribeRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.LocalConn()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	return serverpb.NewClientClient(conn).SubscribeClient(ctx, req)
+}
+
+// httpEvents streams a channel as Server-Sent Events. Each event is the JSON
+// encoded message and its ID is the message timestamp.
+func (s *Server) httpEvents(w http.ResponseWriter, r *http.Request) error {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return errors.Errorf("streaming unsupported")
+	}
+	stream, err := s.subscribeHTTP(r.Context(), r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			// Headers have already been sent so the error can't be returned.
+			s.log.Printf("events stream error: %+v", err)
+			return nil
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Timestamp, body); err != nil {
+			return err
+		}
+		f.Flush()
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// httpWebSocket streams a channel over a WebSocket as JSON encoded messages.
+func (s *Server) httpWebSocket(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream, err := s.subscribeHTTP(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client.
+		s.log.Printf("websocket upgrade error: %+v", err)
+		return nil
+	}
+	defer ws.Close()
+
+	// Drain reads so control frames and client closes are handled.
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			s.log.Printf("websocket stream error: %+v", err)
+			return nil
+		}
+		if err := ws.WriteJSON(msg); err != nil {
+			return nil
+		}
+	}
+}
+
 func (s *Server) httpReference(w http.ResponseWriter, r *http.Request) error {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 3 {
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+func TestSubscribeRequest(t *testing.T) {
+	cases := []struct {
+		url, lastEventID string
+		starting         int64
+		ok               bool
+	}{
+		{"/events/a", "", 0, true},
+		{"/events/a", "10", 10, true},
+		{"/ws/a?starting=20", "", 20, true},
+		{"/events/a?starting=20", "10", 10, true},
+		{"/events/a", "x", 0, false},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", c.url, nil)
+		if c.lastEventID != "" {
+			r.Header.Set("Last-Event-ID", c.lastEventID)
+		}
+		req, err := subscribeRequest(r)
+		if (err == nil) != c.ok {
+			t.Errorf("%d. subscribeRequest(%s) = %v; expected ok %t", i, c.url, err, c.ok)
+			continue
+		}
+		if err == nil && (req.ChannelId != "a" || req.Starting != c.starting) {
+			t.Errorf("%d. subscribeRequest(%s) = %+v; expected starting %d", i, c.url, req, c.starting)
+		}
+	}
+}
+
+func TestHTTPSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	go func() {
+		if err := s.Listen("127.0.0.1:0"); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(PemBlockForKey(priv))
+	ctx := context.Background()
+	resp, err := s.AddReference(ctx, &serverpb.AddReferenceRequest{
+		PrivKey: key,
+		Record:  "a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessID := resp.ReferenceId
+	referenceID, _, err := SplitAccessID(accessID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	var events *http.Response
+	util.SucceedsSoon(t, func() error {
+		var err error
+		events, err = http.Get(ts.URL + "/events/" + accessID)
+		if err != nil {
+			return err
+		}
+		if events.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(events.Body)
+			events.Body.Close()
+			return errors.Errorf("status %d: %s", events.StatusCode, body)
+		}
+		return nil
+	})
+	defer events.Body.Close()
+	if got := events.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q; expected text/event-stream", got)
+	}
+
+	util.SucceedsSoon(t, func() error {
+		if n := s.NumListeners(referenceID); n == 0 {
+			return errors.Errorf("no listeners yet")
+		}
+		return nil
+	})
+	if _, err := s.Publish(ctx, &serverpb.PublishRequest{
+		PrivKey: key,
+		Message: "hello",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each event is an id line with the timestamp, a data line with the JSON
+	// encoded message and a blank line.
+	reader := bufio.NewReader(events.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	var msg serverpb.Message
+	if !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("expected a data line; got %q", lines)
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Message != "hello" {
+		t.Fatalf("expected message hello; got %+v", msg)
+	}
+	if want := fmt.Sprintf("id: %d", msg.Timestamp); lines[0] != want || lines[2] != "" {
+		t.Fatalf("expected event %q followed by a blank line; got %q", want, lines)
+	}
+
+	// Resuming from the last event ID replays the message from history.
+	req, err := http.NewRequest("GET", ts.URL+"/events/"+accessID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", fmt.Sprint(msg.Timestamp))
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+	reader = bufio.NewReader(resumed.Body)
+	if line, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	} else if want := fmt.Sprintf("id: %d\n", msg.Timestamp); line != want {
+		t.Fatalf("expected resumed stream to start with %q; got %q", want, line)
+	}
+
+	// WebSocket clients resume with the starting parameter.
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + fmt.Sprintf("/ws/%s?starting=%d", accessID, msg.Timestamp)
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var wsMsg serverpb.Message
+	if err := ws.ReadJSON(&wsMsg); err != nil {
+		t.Fatal(err)
+	}
+	if wsMsg.Message != "hello" || wsMsg.Signature != msg.Signature {
+		t.Fatalf("expected the published message over the websocket; got %+v", wsMsg)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrRecentlyNotFound = errors.New("recently failed to find")
+
+// negativeCacheTTL is how long failed lookups are remembered for.
+func (s *Server) negativeCacheTTL() time.Duration {
+	return time.Duration(s.config.NegativeCacheTtl) * time.Millisecond
+}
+
+// recentlyNotFound returns whether a lookup of id recently failed.
+func (s *Server) recentlyNotFound(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.mu.notFound[id]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(s.mu.notFound, id)
+		return false
+	}
+	return true
+}
+
+// rememberNotFound records that a lookup of id failed.
+func (s *Server) rememberNotFound(id string) {
+	ttl := s.negativeCacheTTL()
+	if ttl <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, expires := range s.mu.notFound {
+		if now.After(expires) {
+			delete(s.mu.notFound, k)
+		}
+	}
+	s.mu.notFound[id] = now.Add(ttl)
+}
+
+// forgetNotFound forgets a failed lookup of id, e.g. because a provider for
+// it was announced.
+func (s *Server) forgetNotFound(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.mu.notFound, id)
+}
+
+// invalidateNotFoundLocked forgets failed lookups of IDs that a peer's new
+// routing table has a route to that its old one didn't have at the same hop
+// distance. Routes the old table already had were there when the lookup
+// failed, e.g. bloom filter false positives, so they don't invalidate it.
+func (s *Server) invalidateNotFoundLocked(old, rt *serverpb.RoutingTable) {
+	if len(s.mu.notFound) == 0 {
+		return
+	}
+	for hops, bf := range rt.GetFilters() {
+		if len(bf.Slices) == 0 {
+			continue
+		}
+		filter, err := decodeFilter(bf)
+		if err != nil {
+			s.log.Printf("failed to decode filter: %+v", err)
+			continue
+		}
+		var oldFilter *scalableFilter
+		if oldFilters := old.GetFilters(); hops < len(oldFilters) && len(oldFilters[hops].Slices) > 0 {
+			oldFilter, err = decodeFilter(oldFilters[hops])
+			if err != nil {
+				s.log.Printf("failed to decode filter: %+v", err)
+			}
+		}
+		for id := range s.mu.notFound {
+			if filter.TestString(id) && (oldFilter == nil || !oldFilter.TestString(id)) {
+				delete(s.mu.notFound, id)
+			}
+		}
+	}
+}
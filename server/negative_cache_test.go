@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+)
+
+func TestNegativeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path:             dir,
+		NegativeCacheTtl: 60000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.rememberNotFound("a")
+	s.rememberNotFound("b")
+	if !s.recentlyNotFound("a") || !s.recentlyNotFound("b") {
+		t.Fatal("expected failed lookups to be remembered")
+	}
+	if s.recentlyNotFound("c") {
+		t.Fatal("expected c not to be remembered")
+	}
+
+	// A routing table with a new route to a should invalidate it.
+	encode := func(ids ...string) *serverpb.BloomFilter {
+		filter := newScalableFilter(0)
+		for _, id := range ids {
+			filter.AddString(id)
+		}
+		bf, err := filter.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bf
+	}
+	old := &serverpb.RoutingTable{
+		Filters: []*serverpb.BloomFilter{{}, encode("b")},
+	}
+	s.mu.Lock()
+	s.invalidateNotFoundLocked(old, &serverpb.RoutingTable{
+		Filters: []*serverpb.BloomFilter{{}, encode("a", "b")},
+	})
+	s.mu.Unlock()
+
+	if s.recentlyNotFound("a") {
+		t.Error("expected a to be invalidated by the routing table")
+	}
+	// The old table already had a route to b when its lookup failed.
+	if !s.recentlyNotFound("b") {
+		t.Error("expected b to still be remembered")
+	}
+
+	// A shorter route is new too.
+	s.rememberNotFound("a")
+	s.mu.Lock()
+	s.invalidateNotFoundLocked(&serverpb.RoutingTable{
+		Filters: []*serverpb.BloomFilter{{}, encode("a")},
+	}, &serverpb.RoutingTable{
+		Filters: []*serverpb.BloomFilter{encode("a"), encode("a")},
+	})
+	s.mu.Unlock()
+	if s.recentlyNotFound("a") {
+		t.Error("expected a to be invalidated by a shorter route")
+	}
+
+	// Announced providers invalidate it too.
+	s.forgetNotFound("b")
+	if s.recentlyNotFound("b") {
+		t.Error("expected b to be forgotten")
+	}
+
+	// A TTL of 0 disables the cache.
+	s.config.NegativeCacheTtl = 0
+	s.rememberNotFound("c")
+	if s.recentlyNotFound("c") {
+		t.Error("expected negative cache to be disabled")
+	}
+}
@@ -8,13 +8,20 @@ import (
 	"encoding/base64"
 	"fmt"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	ErrNumHops = errors.New("max number of hops reached")
+	// ErrTooLarge is returned instead of documents larger than the request's
+	// max size. Like ErrRequestLoop it's a status error so relaying nodes can
+	// tell it apart, and it's returned unwrapped.
+	ErrTooLarge = status.Error(codes.ResourceExhausted, "document is larger than the requested max size")
 )
 
 func (s *Server) GetRemoteFile(ctx context.Context, req *serverpb.GetRemoteFileRequest) (*serverpb.GetRemoteFileResponse, error) {
@@ -39,53 +46,360 @@ func (s *Server) GetRemoteFile(ctx context.Context, req *serverpb.GetRemoteFileR
 			return nil, errors.Wrapf(ErrNumHops, "documentID: %s", documentID)
 		}
 
-		// Look document up via the network.
-		routes := s.peersWithFile(documentID)
-		if len(routes) == 0 {
-			return nil, errors.Errorf("no routes to document: %s", documentID)
+		// Look document up via the network. Concurrent local requests for the
+		// same document share one fetch.
+		if req.GetNumHops() != -1 {
+			return s.fetchAndCacheFile(ctx, req)
 		}
-		var err error
-		for _, route := range routes {
-			if err != nil {
-				s.log.Printf("GetRemoteFile intermediate error: %+v", err)
-				err = nil
+		if s.recentlyNotFound(documentID) {
+			return nil, errors.Wrapf(ErrRecentlyNotFound, "documentID: %s", documentID)
+		}
+		// Fetches capped to a smaller size can't be shared with uncapped ones.
+		key := "/document/" + documentID
+		if req.GetMaxSize() > 0 {
+			key = fmt.Sprintf("%s?max=%d", key, req.GetMaxSize())
+		}
+		resp, err := s.coalesce(ctx, key, func(ctx context.Context) (interface{}, error) {
+			return s.fetchAndCacheFile(ctx, req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*serverpb.GetRemoteFileResponse), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if max := req.GetMaxSize(); max > 0 && int64(len(body)) > max {
+		return nil, ErrTooLarge
+	}
+
+	resp := &serverpb.GetRemoteFileResponse{
+		Body: body,
+	}
+	return resp, nil
+}
+
+// fetchAndCacheFile fetches the document from the network and caches it.
+func (s *Server) fetchAndCacheFile(ctx context.Context, req *serverpb.GetRemoteFileRequest) (*serverpb.GetRemoteFileResponse, error) {
+	documentID := req.GetDocumentId()
+	fwd, err := s.forwardRequest(req.GetRequestId(), req.GetVisited())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.fetchRemoteFile(ctx, fwd, req)
+	if err != nil {
+		s.forgetRequest(fwd.id)
+		if isTooLarge(err) {
+			return nil, ErrTooLarge
+		}
+		if req.GetNumHops() == -1 && ctx.Err() == nil {
+			s.rememberNotFound(documentID)
+		}
+		return nil, errors.Wrapf(err, "failed to find document: %s", documentID)
+	}
+
+	if err := s.LRUCache(resp, documentID); err != nil {
+		return nil, errors.Wrap(err, "Error in the LRU cache function")
+	}
+
+	return resp, nil
+}
+
+// fetchRemoteFile forwards the request to the peers that can provide the
+// document.
+func (s *Server) fetchRemoteFile(ctx context.Context, fwd forwarded, req *serverpb.GetRemoteFileRequest) (*serverpb.GetRemoteFileResponse, error) {
+	documentID := req.GetDocumentId()
+	routes, err := s.router.FindProviders(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+	routes = s.withoutBlocked(fwd.filter(routes))
+	if len(routes) == 0 {
+		return nil, errors.Errorf("no routes to document: %s", documentID)
+	}
+	req = &serverpb.GetRemoteFileRequest{
+		DocumentId: documentID,
+		NumHops:    req.GetNumHops(),
+		RequestId:  fwd.id,
+		Visited:    fwd.visited,
+		MaxSize:    req.GetMaxSize(),
+	}
+
+	// Only the requesting node fetches directly, nodes relaying a request
+	// just pass it on.
+	if s.config.DirectFetch && req.GetNumHops() == -1 && routes[0].NumHops > 1 {
+		resp, err := s.directFetch(ctx, req, fwd, routes)
+		if err == nil || isTooLarge(err) {
+			return resp, err
+		}
+		s.log.Printf("GetRemoteFile direct fetch failed, relaying: %+v", err)
+	}
+	if s.config.HedgeDelay > 0 && s.config.MaxFanout > 1 {
+		return s.hedgedFetch(ctx, routes, req)
+	}
+	return s.sequentialFetch(ctx, routes, req)
+}
+
+// fetchFromRoute requests the document from the route and verifies its hash.
+func (s *Server) fetchFromRoute(ctx context.Context, route Route, req *serverpb.GetRemoteFileRequest) (*serverpb.GetRemoteFileResponse, error) {
+	documentID := req.GetDocumentId()
+	start := time.Now()
+	resp, err := route.Client.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
+		DocumentId: documentID,
+		NumHops:    remainingHops(req.GetNumHops(), route),
+		RequestId:  req.GetRequestId(),
+		Visited:    req.GetVisited(),
+		MaxSize:    req.GetMaxSize(),
+	})
+	if ctx.Err() != nil {
+		// Cancelled, likely by another route winning a hedged fetch.
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		if isDroppedRequest(err) || isTooLarge(err) {
+			return nil, err
+		}
+		s.recordRequest(route.ID, time.Since(start), err)
+		// Only penalize peers that claimed to hold the document themselves;
+		// failures further away aren't necessarily their fault.
+		if route.NumHops == 1 {
+			s.penalize(route.ID)
+		}
+		return nil, err
+	}
+
+	hash := HashBytes(resp.Body)
+	if hash != documentID {
+		err := errors.Errorf("document hash didn't match requested ID")
+		s.recordRequest(route.ID, time.Since(start), err)
+		s.penalize(route.ID)
+		s.scoreInvalid(route.ID, err)
+		return nil, err
+	}
+	s.recordRequest(route.ID, time.Since(start), nil)
+	s.forgive(route.ID)
+	s.scoreValid(route.ID)
+
+	return resp, nil
+}
+
+// sequentialFetch tries each route in turn until one succeeds.
+func (s *Server) sequentialFetch(ctx context.Context, routes []Route, req *serverpb.GetRemoteFileRequest) (*serverpb.GetRemoteFileResponse, error) {
+	var err error
+	for _, route := range routes {
+		if err != nil {
+			s.log.Printf("GetRemoteFile intermediate error: %+v", err)
+			err = nil
+		}
+
+		var resp *serverpb.GetRemoteFileResponse
+		resp, err = s.fetchFromRoute(ctx, route, req)
+		if err != nil {
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// hedgedFetch requests the document from the best route and starts the next
+// route each time HedgeDelay passes without a response, with at most
+// MaxFanout requests in flight. The first verified response wins and the rest
+// are cancelled.
+func (s *Server) hedgedFetch(ctx context.Context, routes []Route, req *serverpb.GetRemoteFileRequest) (*serverpb.GetRemoteFileResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *serverpb.GetRemoteFileResponse
+		err  error
+	}
+	results := make(chan result, len(routes))
+	next := 0
+	inflight := 0
+	launch := func() {
+		route := routes[next]
+		attempt := *req
+		first := next == 0
+		next++
+		inflight++
+		go func() {
+			// Attempts after the first get their own request ID, otherwise a
+			// node on both routes would drop the later one as a duplicate.
+			// They keep the visited nodes so they still can't loop.
+			if !first {
+				id, err := newRequestID()
+				if err != nil {
+					results <- result{nil, err}
+					return
+				}
+				attempt.RequestId = id
 			}
+			resp, err := s.fetchFromRoute(ctx, route, &attempt)
+			results <- result{resp, err}
+		}()
+	}
+
+	delay := time.Duration(s.config.HedgeDelay) * time.Millisecond
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
-			numHops := req.GetNumHops()
-			if numHops == -1 {
-				numHops = route.NumHops
+	launch()
+	var err error
+	for inflight > 0 {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				return r.resp, nil
 			}
-			var resp *serverpb.GetRemoteFileResponse
-			resp, err = route.Client.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
-				DocumentId: documentID,
-				NumHops:    numHops,
-			})
-			if err != nil {
-				continue
+			s.log.Printf("GetRemoteFile intermediate error: %+v", r.err)
+			err = r.err
+			// Replace the failed request straight away.
+			if next < len(routes) {
+				launch()
 			}
-
-			hash := HashBytes(resp.Body)
-			if hash != documentID {
-				err = errors.Errorf("document hash didn't match requested ID")
-				continue
+		case <-timer.C:
+			if next < len(routes) && inflight < int(s.config.MaxFanout) {
+				launch()
 			}
+			timer.Reset(delay)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
 
-			err = s.LRUCache(resp, documentID)
-			if err != nil {
-				return nil, errors.Wrap(err, "Error in the LRU cache function")
-			}
+// directFetch locates the node holding the document and fetches it from that
+// node directly.
+func (s *Server) directFetch(ctx context.Context, req *serverpb.GetRemoteFileRequest, fwd forwarded, routes []Route) (*serverpb.GetRemoteFileResponse, error) {
+	documentID := req.GetDocumentId()
+	// The lookup gets its own ID, otherwise nodes on the route would drop the
+	// relayed fetch if the direct one fails.
+	id, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.locateProvider(ctx, documentID, -1, forwarded{id: id, visited: fwd.visited}, routes)
+	if err != nil {
+		return nil, err
+	}
+	if s.isBlocked(meta) {
+		return nil, errors.Wrapf(ErrBlocked, "provider %s", meta.Id)
+	}
+	client, done, err := s.dialProvider(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-			return resp, nil
+	start := time.Now()
+	resp, err := client.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
+		DocumentId: documentID,
+		NumHops:    0,
+		MaxSize:    req.GetMaxSize(),
+	})
+	if err == nil && HashBytes(resp.Body) != documentID {
+		err = errors.Errorf("document hash didn't match requested ID")
+		s.scoreInvalid(meta.Id, err)
+	}
+	s.recordRequest(meta.Id, time.Since(start), err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching from %s", meta.Id)
+	}
+	s.scoreValid(meta.Id)
+	return resp, nil
+}
+
+// dialProvider returns a client for the node, reusing the peer connection if
+// there is one. done must be called once the client is no longer needed.
+func (s *Server) dialProvider(ctx context.Context, meta serverpb.NodeMeta) (serverpb.NodeClient, func(), error) {
+	s.mu.Lock()
+	p, ok := s.mu.peers[meta.Id]
+	s.mu.Unlock()
+	if ok {
+		return p.client, func() {}, nil
+	}
+
+	conn, err := s.connectNode(ctx, meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	return serverpb.NewNodeClient(conn), func() { conn.Close() }, nil
+}
+
+// LocateProvider follows the routes to a document or reference and returns
+// the NodeMeta of the node holding it.
+func (s *Server) LocateProvider(ctx context.Context, req *serverpb.LocateProviderRequest) (*serverpb.LocateProviderResponse, error) {
+	id := req.GetId()
+
+	local, err := s.hasLocal(id)
+	if err != nil {
+		return nil, err
+	}
+	if local {
+		meta, err := s.NodeMeta()
+		if err != nil {
+			return nil, err
 		}
-		return nil, errors.Wrapf(err, "failed to find document: %s", documentID)
-	} else if err != nil {
+		return &serverpb.LocateProviderResponse{Provider: &meta}, nil
+	}
+
+	if req.GetNumHops() == 0 {
+		return nil, errors.Wrapf(ErrNumHops, "id: %s", id)
+	}
+	fwd, err := s.forwardRequest(req.GetRequestId(), req.GetVisited())
+	if err != nil {
+		return nil, err
+	}
+	routes, err := s.router.FindProviders(ctx, id)
+	if err != nil {
+		s.forgetRequest(fwd.id)
 		return nil, err
 	}
+	meta, err := s.locateProvider(ctx, id, req.GetNumHops(), fwd, s.withoutBlocked(fwd.filter(routes)))
+	if err != nil {
+		s.forgetRequest(fwd.id)
+		return nil, err
+	}
+	return &serverpb.LocateProviderResponse{Provider: &meta}, nil
+}
+
+func (s *Server) locateProvider(ctx context.Context, id string, numHops int32, fwd forwarded, routes []Route) (serverpb.NodeMeta, error) {
+	if len(routes) == 0 {
+		return serverpb.NodeMeta{}, errors.Errorf("no routes to: %s", id)
+	}
+	var err error
+	for _, route := range routes {
+		if err != nil {
+			s.log.Printf("LocateProvider intermediate error: %+v", err)
+			err = nil
+		}
 
-	resp := &serverpb.GetRemoteFileResponse{
-		Body: body,
+		var resp *serverpb.LocateProviderResponse
+		resp, err = route.Client.LocateProvider(ctx, &serverpb.LocateProviderRequest{
+			Id:        id,
+			NumHops:   remainingHops(numHops, route),
+			RequestId: fwd.id,
+			Visited:   fwd.visited,
+		})
+		if err != nil {
+			continue
+		}
+		if resp.GetProvider() == nil {
+			err = errors.Errorf("missing provider")
+			continue
+		}
+		meta := *resp.GetProvider()
+		if err = validateNodeMeta(meta); err != nil {
+			continue
+		}
+		s.forgetNotFound(id)
+		return meta, nil
 	}
-	return resp, nil
+	return serverpb.NodeMeta{}, errors.Wrapf(err, "failed to locate provider: %s", id)
 }
 
 func (s *Server) GetRemoteReference(ctx context.Context, req *serverpb.GetRemoteReferenceRequest) (*serverpb.GetRemoteReferenceResponse, error) {
@@ -112,75 +426,21 @@ func (s *Server) GetRemoteReference(ctx context.Context, req *serverpb.GetRemote
 			return nil, errors.Wrapf(ErrNumHops, "referenceID: %s", referenceID)
 		}
 
-		// Look reference up via the network.
-		routes := s.peersWithFile(referenceID)
-		if len(routes) == 0 {
-			return nil, errors.Errorf("no routes to reference: %s", referenceID)
+		// Look reference up via the network. Concurrent local requests for the
+		// same reference share one lookup.
+		if req.GetNumHops() != -1 {
+			return s.lookupReference(ctx, req)
 		}
-		var err error
-		for _, route := range routes {
-			if err != nil {
-				s.log.Printf("GetRemoteReference intermediate error: %+v", err)
-				err = nil
-			}
-
-			numHops := req.GetNumHops()
-			if numHops == -1 {
-				numHops = route.NumHops
-			}
-			var resp *serverpb.GetRemoteReferenceResponse
-			err = func() error {
-				resp, err = route.Client.GetRemoteReference(ctx, &serverpb.GetRemoteReferenceRequest{
-					ReferenceId: referenceID,
-					NumHops:     numHops,
-				})
-				if err != nil {
-					return err
-				}
-
-				reference := resp.GetReference()
-
-				signature, err := base64.URLEncoding.DecodeString(reference.Signature)
-				if err != nil {
-					return err
-				}
-				var sig EcdsaSignature
-				if _, err := asn1.Unmarshal(signature, &sig); err != nil {
-					return err
-				}
-
-				hash, err := Hash(reference.PublicKey)
-				if err != nil {
-					return err
-				}
-				if hash != req.GetReferenceId() {
-					return errors.Errorf("public key doesn't match reference ID")
-				}
-
-				publicKey, err := UnmarshalPublic(reference.PublicKey)
-				if err != nil {
-					return err
-				}
-				ref2 := *reference
-				ref2.Signature = ""
-				bytes, err := ref2.Marshal()
-				if err != nil {
-					return err
-				}
-				refHash := sha1.Sum(bytes)
-				if !ecdsa.Verify(publicKey, refHash[:], sig.R, sig.S) {
-					return errors.Errorf("invalid signature received")
-				}
-
-				return nil
-			}()
-			if err != nil {
-				continue
-			}
-
-			return resp, nil
+		if s.recentlyNotFound(referenceID) {
+			return nil, errors.Wrapf(ErrRecentlyNotFound, "referenceID: %s", referenceID)
 		}
-		return nil, errors.Wrapf(err, "failed to find reference: %s", referenceID)
+		resp, err := s.coalesce(ctx, "/reference/"+referenceID, func(ctx context.Context) (interface{}, error) {
+			return s.lookupReference(ctx, req)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*serverpb.GetRemoteReferenceResponse), nil
 	} else if err != nil {
 		// Error wasn't an error relating to the reference not being found locally. Return.
 		return nil, err
@@ -195,3 +455,113 @@ func (s *Server) GetRemoteReference(ctx context.Context, req *serverpb.GetRemote
 		Reference: &reference,
 	}, nil
 }
+
+// lookupReference fetches the reference from the network.
+func (s *Server) lookupReference(ctx context.Context, req *serverpb.GetRemoteReferenceRequest) (*serverpb.GetRemoteReferenceResponse, error) {
+	referenceID := req.GetReferenceId()
+	fwd, err := s.forwardRequest(req.GetRequestId(), req.GetVisited())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.fetchRemoteReference(ctx, fwd, req)
+	if err != nil {
+		s.forgetRequest(fwd.id)
+		if req.GetNumHops() == -1 && ctx.Err() == nil {
+			s.rememberNotFound(referenceID)
+		}
+		return nil, errors.Wrapf(err, "failed to find reference: %s", referenceID)
+	}
+	return resp, nil
+}
+
+// fetchRemoteReference forwards the request to the peers that can provide
+// the reference and verifies the response.
+func (s *Server) fetchRemoteReference(ctx context.Context, fwd forwarded, req *serverpb.GetRemoteReferenceRequest) (*serverpb.GetRemoteReferenceResponse, error) {
+	referenceID := req.GetReferenceId()
+	routes, err := s.router.FindProviders(ctx, referenceID)
+	if err != nil {
+		return nil, err
+	}
+	routes = s.withoutBlocked(fwd.filter(routes))
+	if len(routes) == 0 {
+		return nil, errors.Errorf("no routes to reference: %s", referenceID)
+	}
+	for _, route := range routes {
+		if err != nil {
+			s.log.Printf("GetRemoteReference intermediate error: %+v", err)
+			err = nil
+		}
+
+		var resp *serverpb.GetRemoteReferenceResponse
+		fetchFailed := false
+		start := time.Now()
+		err = func() error {
+			resp, err = route.Client.GetRemoteReference(ctx, &serverpb.GetRemoteReferenceRequest{
+				ReferenceId: referenceID,
+				NumHops:     remainingHops(req.GetNumHops(), route),
+				RequestId:   fwd.id,
+				Visited:     fwd.visited,
+			})
+			if err != nil {
+				fetchFailed = true
+				return err
+			}
+
+			reference := resp.GetReference()
+
+			signature, err := base64.URLEncoding.DecodeString(reference.Signature)
+			if err != nil {
+				return err
+			}
+			var sig EcdsaSignature
+			if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+				return err
+			}
+
+			hash, err := Hash(reference.PublicKey)
+			if err != nil {
+				return err
+			}
+			if hash != req.GetReferenceId() {
+				return errors.Errorf("public key doesn't match reference ID")
+			}
+
+			publicKey, err := UnmarshalPublic(reference.PublicKey)
+			if err != nil {
+				return err
+			}
+			ref2 := *reference
+			ref2.Signature = ""
+			bytes, err := ref2.Marshal()
+			if err != nil {
+				return err
+			}
+			refHash := sha1.Sum(bytes)
+			if !ecdsa.Verify(publicKey, refHash[:], sig.R, sig.S) {
+				return errors.Errorf("invalid signature received")
+			}
+
+			return nil
+		}()
+		if err != nil && fetchFailed && isDroppedRequest(err) {
+			continue
+		}
+		s.recordRequest(route.ID, time.Since(start), err)
+		if err != nil {
+			// Invalid references are always the peer's fault, failed fetches
+			// only if it claimed to hold the reference itself.
+			if !fetchFailed || route.NumHops == 1 {
+				s.penalize(route.ID)
+			}
+			if !fetchFailed {
+				s.scoreInvalid(route.ID, err)
+			}
+			continue
+		}
+		s.forgive(route.ID)
+		s.scoreValid(route.ID)
+
+		return resp, nil
+	}
+	return nil, err
+}
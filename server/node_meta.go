@@ -11,7 +11,6 @@ import (
 	"fmt"
 	"net"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
-	"strconv"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -130,38 +129,11 @@ func (s *Server) NodeMeta() (serverpb.NodeMeta, error) {
 	meta.Id = nodeMetaId(meta)
 
 	if s.mu.l != nil {
-		addr := s.mu.l.Addr()
-		tcpAddr := addr.(*net.TCPAddr)
-		if tcpAddr.IP.IsUnspecified() {
-			port := strconv.Itoa(tcpAddr.Port)
-			meta.Addrs = append(meta.Addrs, net.JoinHostPort(getOutboundIP().String(), port))
-			meta.Addrs = append(meta.Addrs, net.JoinHostPort("localhost", port))
-			/*
-				ifaces, err := net.Interfaces()
-				if err != nil {
-					return serverpb.NodeMeta{}, err
-				}
-				for _, i := range ifaces {
-					addrs, err := i.Addrs()
-					if err != nil {
-						return serverpb.NodeMeta{}, err
-					}
-					for _, addr := range addrs {
-						var ip net.IP
-						switch v := addr.(type) {
-						case *net.IPNet:
-							ip = v.IP
-						case *net.IPAddr:
-							ip = v.IP
-						}
-						possibleAddr := net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port))
-						meta.Addrs = append(meta.Addrs, possibleAddr)
-					}
-				}
-			*/
-		} else {
-			meta.Addrs = append(meta.Addrs, addr.String())
+		addrs, err := s.listenAddrs(s.mu.l.Addr().(*net.TCPAddr))
+		if err != nil {
+			return serverpb.NodeMeta{}, err
 		}
+		meta.Addrs = addrs
 	}
 
 	sig, err := nodeMetaSign(meta, s.key)
@@ -174,15 +146,70 @@ func (s *Server) NodeMeta() (serverpb.NodeMeta, error) {
 }
 
 // addNodeMeta adds a node meta object to the server and returns whether or not
-// that node has been seen before.
+// that node has been seen before. If a newer copy changes a known node's
+// addresses or certificate the node is reconnected to.
 func (s *Server) addNodeMeta(meta serverpb.NodeMeta) bool {
+	new, _ := s.storeNodeMeta(meta)
+	return new
+}
+
+// storeNodeMeta keeps the newest copy of a node's meta and returns whether the
+// node is new and whether the stored copy was replaced.
+func (s *Server) storeNodeMeta(meta serverpb.NodeMeta) (new bool, updated bool) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	old, ok := s.mu.peerMeta[meta.Id]
-	if !ok || old.Updated < meta.Updated {
-		s.mu.peerMeta[meta.Id] = meta
+	if ok && old.Updated >= meta.Updated {
+		s.mu.Unlock()
+		return false, false
+	}
+	s.mu.peerMeta[meta.Id] = meta
+	changed := ok && !sameContact(old, meta)
+	_, unreachable := s.mu.redial[meta.Id]
+	if changed {
+		// Old addresses failing says nothing about the new ones.
+		delete(s.mu.redial, meta.Id)
+	}
+	s.mu.Unlock()
+
+	if changed {
+		if unreachable {
+			if err := s.clearUnreachableSince(meta.Id); err != nil {
+				s.log.Printf("store node meta error: %+v", err)
+			}
+		}
+		go s.reconnectChanged(meta.Id)
+	}
+	return !ok, true
+}
+
+// sameContact returns whether both copies of a node's meta are reached the
+// same way.
+func sameContact(a, b serverpb.NodeMeta) bool {
+	if a.Cert != b.Cert || len(a.Addrs) != len(b.Addrs) {
+		return false
+	}
+	for i := range a.Addrs {
+		if a.Addrs[i] != b.Addrs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rememberNodeMeta stores the node's meta and returns whether the node is new.
+// Nodes sign fresh meta every time they hand it out, e.g. in every discovery
+// announcement, so it's only persisted when the node is new or is reached
+// differently.
+func (s *Server) rememberNodeMeta(meta serverpb.NodeMeta) (bool, error) {
+	s.mu.Lock()
+	old, known := s.mu.peerMeta[meta.Id]
+	s.mu.Unlock()
+
+	new, updated := s.storeNodeMeta(meta)
+	if !updated || (known && sameContact(old, meta)) {
+		return new, nil
 	}
-	return !ok
+	return new, s.persistNodeMeta(meta)
 }
 
 func (s *Server) persistNodeMeta(meta serverpb.NodeMeta) error {
@@ -199,6 +226,55 @@ func (s *Server) persistNodeMeta(meta serverpb.NodeMeta) error {
 	return nil
 }
 
+// loadNodeMeta loads the persisted peers so they can be reconnected to.
+func (s *Server) loadNodeMeta() error {
+	var metas []serverpb.NodeMeta
+	if err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("/NodeMeta/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			body, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var meta serverpb.NodeMeta
+			if err := meta.Unmarshal(body); err != nil {
+				return err
+			}
+			metas = append(metas, meta)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, meta := range metas {
+		if err := validateNodeMeta(meta); err != nil {
+			s.log.Printf("ignoring invalid persisted peer: %+v", err)
+			continue
+		}
+		s.addNodeMeta(meta)
+	}
+	return s.loadUnreachableSince()
+}
+
+// forgetNodeMeta removes a peer from the known and persisted peers.
+func (s *Server) forgetNodeMeta(id string) error {
+	s.mu.Lock()
+	delete(s.mu.peerMeta, id)
+	s.mu.Unlock()
+
+	key := fmt.Sprintf("/NodeMeta/%s", id)
+	return s.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte(unreachablePrefix + id)); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+}
+
 func (s *Server) Meta(ctx context.Context, req *serverpb.MetaRequest) (*serverpb.NodeMeta, error) {
 	meta, err := s.NodeMeta()
 	if err != nil {
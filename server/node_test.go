@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// fetchClient serves GetRemoteFile after a delay and records the requests it
+// gets and whether they were cancelled.
+type fetchClient struct {
+	serverpb.NodeClient
+
+	delay     time.Duration
+	body      []byte
+	requests  chan *serverpb.GetRemoteFileRequest
+	cancelled chan struct{}
+}
+
+func newFetchClient(delay time.Duration, body []byte) *fetchClient {
+	return &fetchClient{
+		delay:     delay,
+		body:      body,
+		requests:  make(chan *serverpb.GetRemoteFileRequest, 1),
+		cancelled: make(chan struct{}),
+	}
+}
+
+func (c *fetchClient) GetRemoteFile(ctx context.Context, in *serverpb.GetRemoteFileRequest, opts ...grpc.CallOption) (*serverpb.GetRemoteFileResponse, error) {
+	c.requests <- in
+	select {
+	case <-time.After(c.delay):
+		return &serverpb.GetRemoteFileResponse{Body: c.body}, nil
+	case <-ctx.Done():
+		close(c.cancelled)
+		return nil, ctx.Err()
+	}
+}
+
+func TestHedgedFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path:       dir,
+		HedgeDelay: 10,
+		MaxFanout:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	body := []byte("document")
+	slow := newFetchClient(time.Minute, body)
+	fast := newFetchClient(0, body)
+	routes := []Route{
+		{ID: "slow", Client: slow, NumHops: 2},
+		{ID: "fast", Client: fast, NumHops: 2},
+	}
+	req := &serverpb.GetRemoteFileRequest{
+		DocumentId: HashBytes(body),
+		NumHops:    -1,
+		RequestId:  "request",
+		Visited:    []string{"a"},
+	}
+
+	resp, err := s.hedgedFetch(context.Background(), routes, req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if string(resp.Body) != string(body) {
+		t.Fatalf("got %q; wanted %q", resp.Body, body)
+	}
+
+	select {
+	case <-slow.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the slow request to be cancelled")
+	}
+
+	slowReq, fastReq := <-slow.requests, <-fast.requests
+	if slowReq.RequestId != "request" {
+		t.Errorf("expected the first attempt to keep the request ID; got %q", slowReq.RequestId)
+	}
+	if fastReq.RequestId == "" || fastReq.RequestId == slowReq.RequestId {
+		t.Errorf("expected the hedged attempt to get its own request ID; got %q", fastReq.RequestId)
+	}
+	for _, r := range []*serverpb.GetRemoteFileRequest{slowReq, fastReq} {
+		if len(r.Visited) != 1 || r.Visited[0] != "a" {
+			t.Errorf("expected visited nodes to be kept; got %v", r.Visited)
+		}
+	}
+}
+
+func TestGetRemoteFileMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	body := []byte("0123456789")
+	documentID := HashBytes(body)
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fmt.Sprintf("/document/%s", documentID)), body)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		maxSize int64
+		ok      bool
+	}{
+		{0, true},
+		{10, true},
+		{9, false},
+	} {
+		_, err := s.GetRemoteFile(ctx, &serverpb.GetRemoteFileRequest{
+			DocumentId: documentID,
+			MaxSize:    c.maxSize,
+		})
+		if c.ok && err != nil {
+			t.Errorf("max size %d: %+v", c.maxSize, err)
+		} else if !c.ok && !isTooLarge(err) {
+			t.Errorf("max size %d: expected ErrTooLarge; got %+v", c.maxSize, err)
+		}
+	}
+
+	// Relaying nodes wrap errors, which still count.
+	if !isTooLarge(errors.Wrap(ErrTooLarge, "relayed")) {
+		t.Error("expected wrapped ErrTooLarge to be detected")
+	}
+}
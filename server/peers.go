@@ -5,7 +5,6 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"log"
 	"net"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/config"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
@@ -16,6 +15,7 @@ import (
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	grpcpeer "google.golang.org/grpc/peer"
 )
 
 const (
@@ -37,6 +37,16 @@ func (s *Server) Hello(ctx context.Context, req *serverpb.HelloRequest) (*server
 	if reqMeta == nil {
 		return nil, errors.Errorf("Meta field required")
 	}
+	if err := checkCaller(ctx, reqMeta.Id); err != nil {
+		return nil, err
+	}
+	if err := s.checkHelloProof(req.GetSwarmProof(), reqMeta.Id, meta.Id); err != nil {
+		return nil, err
+	}
+	resp.SwarmProof = s.helloProof(meta.Id, reqMeta.Id)
+	if p, ok := grpcpeer.FromContext(ctx); ok && s.isBlockedAddr(p.Addr.String()) {
+		return nil, errors.Wrapf(ErrBlocked, "address %s", p.Addr)
+	}
 
 	// Force connection back if we got a hello request. We want to avoid one way
 	// links.
@@ -69,22 +79,30 @@ func (s *Server) connectNode(ctx context.Context, meta serverpb.NodeMeta) (*grpc
 		return nil, errors.Errorf("failed to parse certificate for node %+v", meta)
 	}
 
-	creds := credentials.NewClientTLSFromCert(roots, "")
-	var err error
+	// Present our certificate so the node can check we own our ID.
+	creds := credentials.NewTLS(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{*s.cert},
+	})
+	swarmOpts, err := s.swarmDialOptions()
+	if err != nil {
+		return nil, err
+	}
 	var conn *grpc.ClientConn
 	for _, addr := range meta.Addrs {
 		if err := validateAddr(addr); err != nil {
 			return nil, err
 		}
 		ctx, _ := context.WithTimeout(ctx, dialTimeout)
-		conn, err = grpc.DialContext(ctx, addr,
+		opts := append([]grpc.DialOption{
 			grpc.WithTransportCredentials(creds),
 			grpc.WithBlock(),
 			grpc.WithDefaultCallOptions(
 				grpc.MaxCallRecvMsgSize(int(config.GRPCMsgSize)),
 				grpc.MaxCallSendMsgSize(int(config.GRPCMsgSize)),
 			),
-		)
+		}, swarmOpts...)
+		conn, err = grpc.DialContext(ctx, addr, opts...)
 		if err != nil {
 			s.log.Printf("error dialing %+v: %+v", addr, err)
 			continue
@@ -97,18 +115,6 @@ func (s *Server) connectNode(ctx context.Context, meta serverpb.NodeMeta) (*grpc
 	return conn, nil
 }
 
-// getOutboundIP sets up a UDP connection (but doesn't send anything) and uses
-// the local IP addressed assigned.
-func getOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-
-	return conn.LocalAddr().(*net.UDPAddr).IP
-}
-
 func (s *Server) NumConnections() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -130,11 +136,14 @@ func (s *Server) AddNode(meta serverpb.NodeMeta, force bool) error {
 	if err := validateNodeMeta(meta); err != nil {
 		return err
 	}
+	if s.isBlocked(meta) {
+		return errors.Wrapf(ErrBlocked, "node %s", meta.Id)
+	}
 
 	s.log.Printf("AddNode %s", color.RedString(meta.Id))
 
-	new := s.addNodeMeta(meta)
-	if err := s.persistNodeMeta(meta); err != nil {
+	new, err := s.rememberNodeMeta(meta)
+	if err != nil {
 		return err
 	}
 
@@ -170,7 +179,8 @@ func (s *Server) AddNode(meta serverpb.NodeMeta, force bool) error {
 	}
 	client := serverpb.NewNodeClient(conn)
 	resp, err := client.Hello(ctx, &serverpb.HelloRequest{
-		Meta: &localMeta,
+		Meta:       &localMeta,
+		SwarmProof: s.helloProof(localMeta.Id, meta.Id),
 	})
 	if err != nil {
 		return errors.Wrapf(err, "Hello")
@@ -178,6 +188,11 @@ func (s *Server) AddNode(meta serverpb.NodeMeta, force bool) error {
 	if resp.Meta.Id != meta.Id {
 		return errors.Errorf("expected node with ID %+v; got %+v", meta, resp.Meta)
 	}
+	if err := s.checkHelloProof(resp.GetSwarmProof(), meta.Id, localMeta.Id); err != nil {
+		cancel()
+		conn.Close()
+		return err
+	}
 
 	peer := &peer{
 		ctx:    ctx,
@@ -193,6 +208,7 @@ func (s *Server) AddNode(meta serverpb.NodeMeta, force bool) error {
 	_, ok := s.mu.peers[meta.Id]
 	if !ok {
 		s.mu.peers[meta.Id] = peer
+		delete(s.mu.redial, meta.Id)
 	}
 	s.mu.Unlock()
 
@@ -245,6 +261,19 @@ func (s *Server) LocalConn() (*grpc.ClientConn, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// Advertised addresses may not be reachable from the node itself, so try
+	// loopback first when listening on all interfaces.
+	s.mu.Lock()
+	l := s.mu.l
+	s.mu.Unlock()
+	if l == nil {
+		return nil, errors.Errorf("not listening")
+	}
+	if addr := l.Addr().(*net.TCPAddr); addr.IP.IsUnspecified() {
+		meta.Addrs = append([]string{net.JoinHostPort("localhost", strconv.Itoa(addr.Port))}, meta.Addrs...)
+	}
+
 	return s.connectNode(s.ctx, meta)
 }
 
@@ -259,6 +288,9 @@ func (s *Server) BootstrapAddNode(ctx context.Context, addr string) error {
 	if err := validateAddr(addr); err != nil {
 		return err
 	}
+	if s.isBlockedAddr(addr) {
+		return errors.Wrapf(ErrBlocked, "address %s", addr)
+	}
 
 	creds := credentials.NewTLS(&tls.Config{
 		Rand:               rand.Reader,
@@ -293,10 +325,134 @@ type peer struct {
 	client       serverpb.NodeClient
 	conn         *grpc.ClientConn
 	routingTable *serverpb.RoutingTable
+	// penalty counts recent bad routing tables and failed fetches. Peers at or
+	// above routingPenaltyThreshold aren't used as routes.
+	penalty int
+	stats   peerStats
 
 	s *Server
 }
 
+const (
+	// latencyWeight is the weight given to each new latency sample.
+	latencyWeight = 0.2
+	// failingPeerThreshold is the number of consecutive failures after which a
+	// peer is skipped when other routes exist.
+	failingPeerThreshold = 3
+	// failingPeerBackoff is how long a failing peer is skipped for.
+	failingPeerBackoff = 10 * time.Second
+)
+
+// peerStats tracks how well requests to a peer have gone.
+type peerStats struct {
+	latency             time.Duration
+	successes           int64
+	failures            int64
+	consecutiveFailures int
+	lastFailure         time.Time
+}
+
+func (st *peerStats) observeLatency(d time.Duration) {
+	if st.latency == 0 {
+		st.latency = d
+		return
+	}
+	st.latency = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(st.latency))
+}
+
+func (st *peerStats) record(d time.Duration, err error) {
+	if err != nil {
+		st.failures++
+		st.consecutiveFailures++
+		st.lastFailure = time.Now()
+		return
+	}
+	st.successes++
+	st.consecutiveFailures = 0
+	st.observeLatency(d)
+}
+
+// successRate returns the smoothed fraction of requests that succeeded.
+func (st *peerStats) successRate() float64 {
+	return float64(st.successes+1) / float64(st.successes+st.failures+2)
+}
+
+// cost is the expected time to a successful response. Lower is better. Peers
+// without any latency samples cost nothing so they get tried.
+func (st *peerStats) cost() float64 {
+	return float64(st.latency) / st.successRate()
+}
+
+func (st *peerStats) failing() bool {
+	return st.consecutiveFailures >= failingPeerThreshold &&
+		time.Since(st.lastFailure) < failingPeerBackoff
+}
+
+// recordRequest records the outcome and latency of a request to the peer.
+func (s *Server) recordRequest(id string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.mu.peers[id]; ok {
+		p.stats.record(d, err)
+	}
+}
+
+func (p *peer) statsPB() *serverpb.PeerStats {
+	return &serverpb.PeerStats{
+		Id:                  p.meta.Id,
+		LatencyMs:           float64(p.stats.latency) / float64(time.Millisecond),
+		Successes:           p.stats.successes,
+		Failures:            p.stats.failures,
+		ConsecutiveFailures: int32(p.stats.consecutiveFailures),
+		LastFailure:         unixOrZero(p.stats.lastFailure),
+		Penalty:             int32(p.penalty),
+		Failing:             p.stats.failing(),
+		Score:               int32(p.s.mu.scores[p.meta.Id]),
+	}
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+const (
+	// routingPenaltyThreshold is the penalty at which a peer stops being used
+	// for routing.
+	routingPenaltyThreshold = 5
+	// maxRoutingPenalty caps the penalty so that peers can recover.
+	maxRoutingPenalty = 2 * routingPenaltyThreshold
+)
+
+func (p *peer) penalizeLocked() {
+	if p.penalty < maxRoutingPenalty {
+		p.penalty++
+	}
+}
+
+// penalize records a failure from the peer, such as a failed fetch.
+func (s *Server) penalize(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.mu.peers[id]; ok {
+		p.penalizeLocked()
+	}
+}
+
+// forgive reduces the peer's penalty after it behaves well.
+func (s *Server) forgive(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.mu.peers[id]; ok && p.penalty > 0 {
+		p.penalty--
+	}
+}
+
 func (p *peer) Close() {
 	p.s.mu.Lock()
 	defer p.s.mu.Unlock()
@@ -324,10 +480,14 @@ func (p *peer) heartbeat() {
 		}
 
 		ctx, _ := context.WithTimeout(p.ctx, dialTimeout)
+		start := time.Now()
 		if _, err := p.client.HeartBeat(ctx, &serverpb.HeartBeatRequest{}); err != nil {
 			p.s.log.Printf("heartbeat error: %s: %+v", color.RedString(p.meta.Id), err)
 			p.Close()
 			return
 		}
+		p.s.mu.Lock()
+		p.stats.observeLatency(time.Since(start))
+		p.s.mu.Unlock()
 	}
 }
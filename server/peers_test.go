@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPeerStats(t *testing.T) {
+	var fast, slow, flaky peerStats
+	for i := 0; i < 10; i++ {
+		fast.record(10*time.Millisecond, nil)
+		slow.record(100*time.Millisecond, nil)
+		flaky.record(10*time.Millisecond, nil)
+		flaky.record(0, errors.New("failed"))
+	}
+
+	if !(fast.cost() < slow.cost()) {
+		t.Errorf("expected fast peer to cost less than slow peer: %f >= %f", fast.cost(), slow.cost())
+	}
+	if !(fast.cost() < flaky.cost()) {
+		t.Errorf("expected fast peer to cost less than flaky peer: %f >= %f", fast.cost(), flaky.cost())
+	}
+
+	if fast.failing() {
+		t.Error("expected fast peer not to be failing")
+	}
+	for i := 0; i < failingPeerThreshold; i++ {
+		fast.record(0, errors.New("failed"))
+	}
+	if !fast.failing() {
+		t.Error("expected peer to be failing after consecutive failures")
+	}
+	fast.record(10*time.Millisecond, nil)
+	if fast.failing() {
+		t.Error("expected a success to clear failing")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+)
+
+// prefetchItem is a document queued for prefetching.
+type prefetchItem struct {
+	accessID string
+	depth    int32
+}
+
+// prefetchDirectory fetches the directory's children in the background so
+// they're local by the time they're requested. It does nothing if
+// prefetching is disabled or the directory is already being prefetched.
+func (s *Server) prefetchDirectory(accessID string, dir *serverpb.Document) {
+	if s.config.PrefetchDepth <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.mu.prefetching[accessID]; ok {
+		return
+	}
+	s.mu.prefetching[accessID] = struct{}{}
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			delete(s.mu.prefetching, accessID)
+		}()
+
+		n, err := s.prefetch(accessID, dir)
+		if err != nil {
+			s.log.Printf("prefetch %s error: %+v", accessID, err)
+			return
+		}
+		s.log.Printf("prefetched %d bytes of %s", n, accessID)
+	}()
+}
+
+// prefetch walks the directory breadth first down to PrefetchDepth levels,
+// fetching documents that aren't local until PrefetchBytes have been fetched.
+// Documents larger than what's left of the budget are skipped. It returns the
+// number of bytes fetched.
+func (s *Server) prefetch(accessID string, dir *serverpb.Document) (int64, error) {
+	budget := s.config.PrefetchBytes
+	var fetched int64
+	seen := map[string]bool{accessID: true}
+	queue := prefetchChildren(dir, 1)
+
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+		if seen[item.accessID] {
+			continue
+		}
+		seen[item.accessID] = true
+
+		documentID, accessKey, err := SplitAccessID(item.accessID)
+		if err != nil {
+			s.log.Printf("prefetch %s: %+v", item.accessID, err)
+			continue
+		}
+		local, err := s.hasLocal(documentID)
+		if err != nil {
+			return fetched, err
+		}
+		// Directory listings don't say how big their children are, so the
+		// node holding the document refuses it if it doesn't fit.
+		var maxSize int64
+		if !local && budget > 0 {
+			maxSize = budget - fetched
+			if maxSize <= 0 {
+				break
+			}
+		}
+
+		resp, err := s.GetRemoteFile(s.ctx, &serverpb.GetRemoteFileRequest{
+			DocumentId: documentID,
+			NumHops:    -1,
+			MaxSize:    maxSize,
+		})
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return fetched, s.ctx.Err()
+			}
+			if isTooLarge(err) {
+				s.log.Printf("prefetch %s: skipping, larger than the %d bytes left", item.accessID, maxSize)
+				continue
+			}
+			s.log.Printf("prefetch %s: %+v", item.accessID, err)
+			continue
+		}
+		if !local {
+			fetched += int64(len(resp.Body))
+		}
+
+		doc, err := s.DecryptDocument(resp.Body, accessKey)
+		if err != nil {
+			s.log.Printf("prefetch %s: %+v", item.accessID, err)
+			continue
+		}
+		if doc.GetContentType() == "directory" && item.depth < s.config.PrefetchDepth {
+			queue = append(queue, prefetchChildren(&doc, item.depth+1)...)
+		}
+	}
+	return fetched, nil
+}
+
+// prefetchChildren returns the directory's children in name order.
+func prefetchChildren(dir *serverpb.Document, depth int32) []prefetchItem {
+	var names []string
+	for name := range dir.GetChildren() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var items []prefetchItem
+	for _, name := range names {
+		items = append(items, prefetchItem{
+			accessID: dir.Children[name],
+			depth:    depth,
+		})
+	}
+	return items
+}
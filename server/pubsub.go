@@ -12,16 +12,23 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// maxChannelHistory is the number of recently published messages kept per
+	// channel so that resuming subscribers can catch up.
+	maxChannelHistory = 100
+	// channelIdleTTL is how long a channel and its history are kept after its
+	// last listener leaves, so disconnected subscribers can still resume.
+	channelIdleTTL = 10 * time.Minute
+)
+
 type channel struct {
 	listeners map[int]chan *serverpb.Message
+	history   []*serverpb.Message
+	// idleSince is when the last listener left.
+	idleSince time.Time
 }
 
-func (s *Server) listen(ref string) (<-chan *serverpb.Message, func()) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	id := s.mu.nextListenerID
-	s.mu.nextListenerID++
+func (s *Server) channelLocked(ref string) *channel {
 	ch, ok := s.mu.channels[ref]
 	if !ok {
 		ch = &channel{
@@ -29,14 +36,53 @@ func (s *Server) listen(ref string) (<-chan *serverpb.Message, func()) {
 		}
 		s.mu.channels[ref] = ch
 	}
+	return ch
+}
+
+// expireChannel frees the channel if it has stayed without listeners for
+// channelIdleTTL.
+func (s *Server) expireChannel(ref string, ch *channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(ch.listeners) == 0 && time.Since(ch.idleSince) >= channelIdleTTL && s.mu.channels[ref] == ch {
+		delete(s.mu.channels, ref)
+	}
+}
+
+// listen registers a listener on the channel. If starting is non-zero, any
+// retained messages with a timestamp at or after starting are returned as a
+// backlog that must be sent before reading from the channel.
+func (s *Server) listen(ref string, starting int64) (<-chan *serverpb.Message, []*serverpb.Message, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.mu.nextListenerID
+	s.mu.nextListenerID++
+	ch := s.channelLocked(ref)
+
+	var backlog []*serverpb.Message
+	if starting > 0 {
+		for _, msg := range ch.history {
+			if msg.Timestamp >= starting {
+				backlog = append(backlog, msg)
+			}
+		}
+	}
 
 	c := make(chan *serverpb.Message, 10)
 	ch.listeners[id] = c
 
-	return c, func() {
+	return c, backlog, func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 		delete(ch.listeners, id)
+		if len(ch.listeners) == 0 {
+			ch.idleSince = time.Now()
+			time.AfterFunc(channelIdleTTL, func() {
+				s.expireChannel(ref, ch)
+			})
+		}
 	}
 }
 
@@ -54,45 +100,65 @@ func (s *Server) Subscribe(req *serverpb.SubscribeRequest, stream serverpb.Node_
 			return errors.Wrapf(ErrNumHops, "referenceID: %s", referenceID)
 		}
 
-		// Look reference up via the network.
-		routes := s.peersWithFile(referenceID)
+		// Look reference up via the network. The request is remembered for as
+		// long as the subscription is forwarded.
+		fwd, err := s.forwardRequest(req.GetRequestId(), req.GetVisited())
+		if err != nil {
+			return err
+		}
+		defer s.forgetRequest(fwd.id)
+
+		routes, err := s.router.FindProviders(stream.Context(), referenceID)
+		if err != nil {
+			return err
+		}
+		routes = fwd.filter(routes)
 		if len(routes) == 0 {
 			return errors.Errorf("no routes to reference: %s", referenceID)
 		}
+
+		// Timestamps come from the publisher's clock, so live subscriptions
+		// don't filter on them. Only messages that were already delivered
+		// are skipped after failing over.
+		cursor := newSubscriptionCursor(req.GetStarting())
+		starting := req.GetStarting()
+
 		for _, route := range routes {
-			numHops := req.GetNumHops()
-			if numHops == -1 {
-				numHops = route.NumHops
-			}
-			clientStream, err := route.Client.Subscribe(stream.Context(), &serverpb.SubscribeRequest{
-				ChannelId: referenceID,
-				Starting:  req.Starting,
-				NumHops:   numHops,
-			})
 			if err != nil {
-				s.log.Printf("failed to find file: %+v", err)
-				continue
+				s.log.Printf("Subscribe intermediate error: %+v", err)
+				err = nil
 			}
 
-			for {
-				msg, err := clientStream.Recv()
-				if err != nil {
-					return err
-				}
-				if err := stream.Send(msg); err != nil {
-					return err
-				}
+			err = s.forwardSubscription(stream, route, &serverpb.SubscribeRequest{
+				ChannelId: referenceID,
+				Starting:  starting,
+				NumHops:   remainingHops(req.GetNumHops(), route),
+				RequestId: fwd.id,
+				Visited:   fwd.visited,
+			}, cursor)
+			if ctxErr := stream.Context().Err(); ctxErr != nil {
+				return ctxErr
+			}
+			// Resume the next route after the last delivered message.
+			if cursor.last > 0 {
+				starting = cursor.last
 			}
 		}
-		return errors.Errorf("failed to find reference: %s", referenceID)
+		return errors.Wrapf(err, "failed to find reference: %s", referenceID)
 	} else if err != nil {
 		// Error wasn't an error relating to the reference not being found locally. Return.
 		return err
 	}
 
-	channel, cleanup := s.listen(referenceID)
+	channel, backlog, cleanup := s.listen(referenceID, req.GetStarting())
 	defer cleanup()
 
+	for _, msg := range backlog {
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+
 	for msg := range channel {
 		if err := stream.Send(msg); err != nil {
 			return err
@@ -124,6 +190,10 @@ func (s *Server) Publish(ctx context.Context, req *serverpb.PublishRequest) (*se
 		PublicKey: pubKey,
 		Timestamp: time.Now().Unix(),
 	}
+	msg.Payload, err = encryptPayload(key, req)
+	if err != nil {
+		return nil, err
+	}
 	bytes, err := msg.Marshal()
 	if err != nil {
 		return nil, err
@@ -145,11 +215,14 @@ func (s *Server) Publish(ctx context.Context, req *serverpb.PublishRequest) (*se
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Only channels that have been subscribed to keep history.
 	ch, ok := s.mu.channels[referenceId]
 	if !ok {
-		return &serverpb.PublishResponse{
-			Listeners: 0,
-		}, nil
+		return &serverpb.PublishResponse{}, nil
+	}
+	ch.history = append(ch.history, msg)
+	if len(ch.history) > maxChannelHistory {
+		ch.history = ch.history[len(ch.history)-maxChannelHistory:]
 	}
 
 	listeners := int32(0)
@@ -168,6 +241,62 @@ func (s *Server) Publish(ctx context.Context, req *serverpb.PublishRequest) (*se
 	}, nil
 }
 
+// subscriptionCursor tracks the newest message delivered on a forwarded
+// subscription so that it can be resumed on another route without duplicating
+// or dropping messages.
+type subscriptionCursor struct {
+	last int64
+	// seen holds the signatures of the messages delivered with timestamp last.
+	seen map[string]struct{}
+}
+
+func newSubscriptionCursor(starting int64) *subscriptionCursor {
+	return &subscriptionCursor{
+		last: starting,
+		seen: map[string]struct{}{},
+	}
+}
+
+// deliver records msg and returns whether it hasn't been delivered before.
+func (c *subscriptionCursor) deliver(msg *serverpb.Message) bool {
+	if msg.Timestamp < c.last {
+		return false
+	}
+	if msg.Timestamp > c.last {
+		c.last = msg.Timestamp
+		c.seen = map[string]struct{}{}
+	}
+	if _, ok := c.seen[msg.Signature]; ok {
+		return false
+	}
+	c.seen[msg.Signature] = struct{}{}
+	return true
+}
+
+// forwardSubscription relays messages from the route to the stream until the
+// upstream subscription fails.
+func (s *Server) forwardSubscription(stream serverpb.Node_SubscribeServer, route Route, req *serverpb.SubscribeRequest, cursor *subscriptionCursor) error {
+	start := time.Now()
+	clientStream, err := route.Client.Subscribe(stream.Context(), req)
+	s.recordRequest(route.ID, time.Since(start), err)
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := clientStream.Recv()
+		if err != nil {
+			return errors.Wrapf(err, "route %s", route.ID)
+		}
+		if !cursor.deliver(msg) {
+			continue
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
 func (s *Server) SubscribeClient(req *serverpb.SubscribeRequest, stream serverpb.Client_SubscribeClientServer) error {
 	// Trim the encryption key off the end of the channel ID.
 	channelId, accessKey, err := SplitAccessID(req.ChannelId)
@@ -199,12 +328,55 @@ func (s *Server) SubscribeClient(req *serverpb.SubscribeRequest, stream serverpb
 		}
 		msg.Message = string(message)
 
+		if err := decryptPayload(accessKey, msg); err != nil {
+			return err
+		}
+
 		if err := stream.Send(msg); err != nil {
 			return err
 		}
 	}
 }
 
+// encryptPayload encrypts the request's data, content type and headers. It
+// returns nil if the request has none.
+func encryptPayload(key []byte, req *serverpb.PublishRequest) ([]byte, error) {
+	if len(req.GetData()) == 0 && req.GetContentType() == "" && len(req.GetHeaders()) == 0 {
+		return nil, nil
+	}
+	payload := serverpb.MessagePayload{
+		Data:        req.GetData(),
+		ContentType: req.GetContentType(),
+		Headers:     req.GetHeaders(),
+	}
+	body, err := payload.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return EncryptBytes(key, body)
+}
+
+// decryptPayload replaces the message's encrypted payload with its data,
+// content type and headers.
+func decryptPayload(key []byte, msg *serverpb.Message) error {
+	if len(msg.Payload) == 0 {
+		return nil
+	}
+	body, err := DecryptBytes(key, msg.Payload)
+	if err != nil {
+		return err
+	}
+	var payload serverpb.MessagePayload
+	if err := payload.Unmarshal(body); err != nil {
+		return err
+	}
+	msg.Payload = nil
+	msg.Data = payload.Data
+	msg.ContentType = payload.ContentType
+	msg.Headers = payload.Headers
+	return nil
+}
+
 func (s *Server) NumListeners(referenceID string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
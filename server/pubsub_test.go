@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"reflect"
+	"testing"
+)
+
+func TestSubscriptionCursor(t *testing.T) {
+	c := newSubscriptionCursor(10)
+
+	cases := []struct {
+		msg  *serverpb.Message
+		want bool
+	}{
+		{&serverpb.Message{Timestamp: 9, Signature: "a"}, false},
+		{&serverpb.Message{Timestamp: 10, Signature: "a"}, true},
+		{&serverpb.Message{Timestamp: 10, Signature: "a"}, false},
+		{&serverpb.Message{Timestamp: 10, Signature: "b"}, true},
+		{&serverpb.Message{Timestamp: 11, Signature: "a"}, true},
+		{&serverpb.Message{Timestamp: 10, Signature: "c"}, false},
+		{&serverpb.Message{Timestamp: 11, Signature: "b"}, true},
+	}
+
+	for i, c2 := range cases {
+		if got := c.deliver(c2.msg); got != c2.want {
+			t.Errorf("%d. deliver(%+v) = %t; want %t", i, c2.msg, got, c2.want)
+		}
+	}
+
+	// Live subscriptions deliver messages whatever the publisher's clock says.
+	live := newSubscriptionCursor(0)
+	if !live.deliver(&serverpb.Message{Timestamp: 1, Signature: "a"}) {
+		t.Error("expected live subscription to deliver a message with an old timestamp")
+	}
+}
+
+func TestMessagePayload(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, err := encryptPayload(key, &serverpb.PublishRequest{Message: "a"}); err != nil || payload != nil {
+		t.Fatalf("expected no payload for a plain message; got %x, %v", payload, err)
+	}
+
+	req := &serverpb.PublishRequest{
+		Data:        []byte{0, 1, 2, 0xff},
+		ContentType: "application/octet-stream",
+		Headers:     map[string]string{"a": "b"},
+	}
+	payload, err := encryptPayload(key, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(payload, req.Data) {
+		t.Fatal("expected payload to be encrypted")
+	}
+
+	msg := &serverpb.Message{Payload: payload}
+	if err := decryptPayload(key, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload != nil || !bytes.Equal(msg.Data, req.Data) || msg.ContentType != req.ContentType || !reflect.DeepEqual(msg.Headers, req.Headers) {
+		t.Fatalf("payload didn't round trip: %+v", msg)
+	}
+}
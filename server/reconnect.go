@@ -0,0 +1,211 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ReconnectInterval is how often disconnected known peers are redialed
+	// when the node has fewer than MaxPeers connections.
+	ReconnectInterval = 2 * time.Second
+	// PeerExpiry is how long a peer can be unreachable before it's forgotten.
+	PeerExpiry = 7 * 24 * time.Hour
+)
+
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 10 * time.Minute
+
+	unreachablePrefix = "/NodeUnreachable/"
+)
+
+// redialState tracks failed attempts to reconnect to a peer. It's cleared
+// once the peer is connected again.
+type redialState struct {
+	attempts int
+	next     time.Time
+	// unreachableSince is when the first failed attempt was made.
+	unreachableSince time.Time
+}
+
+// backoff returns how long to wait after the given number of failed
+// attempts: exponential up to reconnectMaxBackoff, with the upper half
+// randomized so peers don't redial in lockstep.
+func backoff(attempts int) time.Duration {
+	d := reconnectMinBackoff
+	for i := 1; i < attempts && d < reconnectMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > reconnectMaxBackoff {
+		d = reconnectMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reconnectPeers redials known peers that aren't connected until the server
+// is closed.
+func (s *Server) reconnectPeers() {
+	for {
+		select {
+		case <-time.After(ReconnectInterval):
+		case <-s.ctx.Done():
+			return
+		}
+
+		s.redialPeers()
+	}
+}
+
+// redialPeers starts reconnecting to as many known peers as there are free
+// connection slots, skipping peers that are still backing off.
+func (s *Server) redialPeers() {
+	localID, err := s.getLocalId()
+	if err != nil {
+		s.log.Printf("reconnect error: %+v", err)
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	free := int(s.config.MaxPeers) - len(s.mu.peers)
+	var candidates []string
+	for id := range s.mu.peerMeta {
+		if free <= 0 {
+			break
+		}
+		if id == localID {
+			continue
+		}
+		if _, ok := s.mu.peers[id]; ok {
+			continue
+		}
+		if _, ok := s.mu.connecting[id]; ok {
+			continue
+		}
+		if state, ok := s.mu.redial[id]; ok && now.Before(state.next) {
+			continue
+		}
+		if s.blockedIDLocked(id) {
+			continue
+		}
+		candidates = append(candidates, id)
+		free--
+	}
+	s.mu.Unlock()
+
+	for _, id := range candidates {
+		go s.redial(id)
+	}
+}
+
+func (s *Server) redial(id string) {
+	s.mu.Lock()
+	meta, ok := s.mu.peerMeta[id]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	err := s.AddNode(meta, true)
+
+	s.mu.Lock()
+	state, ok := s.mu.redial[id]
+	if err == nil {
+		delete(s.mu.redial, id)
+		s.mu.Unlock()
+		if ok {
+			if err := s.clearUnreachableSince(id); err != nil {
+				s.log.Printf("reconnect error: %+v", err)
+			}
+		}
+		return
+	}
+	now := time.Now()
+	if !ok {
+		state = &redialState{unreachableSince: now}
+		s.mu.redial[id] = state
+	}
+	first := state.attempts == 0
+	state.attempts++
+	state.next = now.Add(backoff(state.attempts))
+	attempts := state.attempts
+	since := state.unreachableSince
+	unreachable := now.Sub(since)
+	s.mu.Unlock()
+
+	s.log.Printf("reconnect %s failed (attempt %d): %+v", color.RedString(id), attempts, err)
+
+	if first {
+		if err := s.saveUnreachableSince(id, since); err != nil {
+			s.log.Printf("reconnect error: %+v", err)
+		}
+	}
+
+	// Peers that have been unreachable for a long time are aged out. This uses
+	// the local clock rather than meta.Updated, which peers set to the current
+	// time whenever they hand out their meta.
+	if unreachable > PeerExpiry {
+		s.log.Printf("forgetting unreachable peer %s", color.RedString(id))
+		s.mu.Lock()
+		delete(s.mu.redial, id)
+		s.mu.Unlock()
+		if err := s.forgetNodeMeta(id); err != nil {
+			s.log.Printf("forget peer error: %+v", err)
+		}
+	}
+}
+
+// saveUnreachableSince persists when reconnecting to a peer first failed so
+// that restarting doesn't reset how long it has been unreachable.
+func (s *Server) saveUnreachableSince(id string, since time.Time) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(unreachablePrefix+id), []byte(strconv.FormatInt(since.Unix(), 10)))
+	})
+}
+
+func (s *Server) clearUnreachableSince(id string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(unreachablePrefix + id))
+	})
+}
+
+// loadUnreachableSince restores when each persisted peer became unreachable.
+// The peers are redialed straight away, but keep aging out from then.
+func (s *Server) loadUnreachableSince() error {
+	since := map[string]time.Time{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(unreachablePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			unix, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return errors.Wrapf(err, "%s", it.Item().Key())
+			}
+			since[strings.TrimPrefix(string(it.Item().Key()), unreachablePrefix)] = time.Unix(unix, 0)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range since {
+		s.mu.redial[id] = &redialState{unreachableSince: t}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+	"time"
+)
+
+func TestUnreachableSincePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := s.saveUnreachableSince("a", since); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveUnreachableSince("b", since); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.clearUnreachableSince("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.mu.redial["a"]
+	if !ok || !state.unreachableSince.Equal(since) {
+		t.Errorf("expected a to be unreachable since %s after restart; got %+v", since, state)
+	}
+	if ok && state.attempts != 0 {
+		t.Errorf("expected a to be redialed straight away; got %+v", state)
+	}
+	if _, ok := s.mu.redial["b"]; ok {
+		t.Errorf("expected b to be cleared")
+	}
+}
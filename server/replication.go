@@ -0,0 +1,373 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+var (
+	// RepairInterval is how often documents are checked for lost replicas.
+	RepairInterval = 10 * time.Second
+)
+
+const replicasPrefix = "/replicas/"
+
+var ErrReplicaQuota = errors.New("replica quota exceeded")
+
+// Replicate stores a copy of a document pushed by a peer. Replicas are kept
+// rather than evicted like cached documents, so they're limited to the
+// node's replica quota.
+func (s *Server) Replicate(ctx context.Context, req *serverpb.ReplicateRequest) (*serverpb.ReplicateResponse, error) {
+	documentID := req.GetDocumentId()
+	if HashBytes(req.GetBody()) != documentID {
+		return nil, errors.Errorf("document hash didn't match ID: %s", documentID)
+	}
+
+	localID, err := s.getLocalId()
+	if err != nil {
+		return nil, err
+	}
+
+	// Already holding it, just learn about the other holders.
+	set, ok, err := s.loadReplicaSet(documentID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		set.Holders = mergeHolders(set.Holders, req.GetHolders())
+		if err := s.saveReplicaSet(documentID, set); err != nil {
+			return nil, err
+		}
+		return &serverpb.ReplicateResponse{}, nil
+	}
+
+	size := int64(len(req.GetBody()))
+	s.mu.Lock()
+	if s.mu.replicaBytes+size > s.config.ReplicaQuota {
+		s.mu.Unlock()
+		return nil, errors.Wrapf(ErrReplicaQuota, "document %s", documentID)
+	}
+	s.mu.replicaBytes += size
+	s.mu.Unlock()
+
+	s.log.Printf("Replicate %s", documentID)
+
+	set = serverpb.ReplicaSet{
+		Replication: req.GetReplication(),
+		Holders:     mergeHolders([]string{localID}, req.GetHolders()),
+		Size:        size,
+		Held:        true,
+	}
+	b, err := set.Marshal()
+	if err != nil {
+		s.releaseReplicaBytes(size)
+		return nil, err
+	}
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte(fmt.Sprintf("/client/%s", documentID))); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(replicasPrefix+documentID), b); err != nil {
+			return err
+		}
+		return txn.Set([]byte(fmt.Sprintf("/document/%s", documentID)), req.GetBody())
+	}); err != nil {
+		s.releaseReplicaBytes(size)
+		return nil, err
+	}
+
+	// The replica is stored and charged to the quota, so a failed announcement
+	// shouldn't make the pusher try another peer. The router announces it
+	// again when it republishes or rebuilds its routing table.
+	if err := s.router.Provide(ctx, documentID); err != nil {
+		s.log.Printf("replicate %s: announcing: %+v", documentID, err)
+	}
+
+	return &serverpb.ReplicateResponse{}, nil
+}
+
+func (s *Server) releaseReplicaBytes(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mu.replicaBytes -= size
+}
+
+// mergeHolders returns a with the holders from b it doesn't already have.
+func mergeHolders(a, b []string) []string {
+	seen := map[string]bool{}
+	for _, id := range a {
+		seen[id] = true
+	}
+	for _, id := range b {
+		if !seen[id] {
+			seen[id] = true
+			a = append(a, id)
+		}
+	}
+	return a
+}
+
+// replicate pushes a newly added document to replication peers and records
+// where it was pushed to so the repairer can maintain it. The document is
+// already stored, so failures are only logged.
+func (s *Server) replicate(ctx context.Context, documentID string, body []byte, replication int32) {
+	localID, err := s.getLocalId()
+	if err != nil {
+		s.log.Printf("replicate %s: %+v", documentID, err)
+		return
+	}
+	set := serverpb.ReplicaSet{
+		Replication: replication,
+	}
+	set.Holders = s.pushReplicas(ctx, documentID, body, replication, []string{localID})
+	if len(set.Holders) <= int(replication) {
+		s.log.Printf("replicated %s to %d of %d peers", documentID, len(set.Holders)-1, replication)
+	}
+	if err := s.saveReplicaSet(documentID, set); err != nil {
+		s.log.Printf("replicate %s: saving replica set: %+v", documentID, err)
+	}
+}
+
+// pushReplicas pushes the document to the best connected peers that don't
+// already hold it until the document has a copy on replication peers besides
+// one of the holders. It returns the nodes holding it.
+func (s *Server) pushReplicas(ctx context.Context, documentID string, body []byte, replication int32, holders []string) []string {
+	held := map[string]bool{}
+	for _, id := range holders {
+		held[id] = true
+	}
+
+	s.mu.Lock()
+	var candidates []*peer
+	for id, p := range s.mu.peers {
+		if !held[id] {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].stats.cost() < candidates[j].stats.cost()
+	})
+	s.mu.Unlock()
+
+	for _, p := range candidates {
+		if len(holders) > int(replication) {
+			break
+		}
+		start := time.Now()
+		_, err := p.client.Replicate(ctx, &serverpb.ReplicateRequest{
+			DocumentId:  documentID,
+			Body:        body,
+			Replication: replication,
+			Holders:     append(holders[:len(holders):len(holders)], p.meta.Id),
+		})
+		s.recordRequest(p.meta.Id, time.Since(start), err)
+		if err != nil {
+			s.log.Printf("replicate %s to %s: %+v", documentID, color.RedString(p.meta.Id), err)
+			continue
+		}
+		holders = append(holders, p.meta.Id)
+	}
+	return holders
+}
+
+// loadReplicaSet returns the replica set of the document and whether there is
+// one.
+func (s *Server) loadReplicaSet(documentID string) (serverpb.ReplicaSet, bool, error) {
+	var set serverpb.ReplicaSet
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(replicasPrefix + documentID))
+		if err != nil {
+			return err
+		}
+		v, err := item.Value()
+		if err != nil {
+			return err
+		}
+		return set.Unmarshal(v)
+	})
+	if err == badger.ErrKeyNotFound {
+		return serverpb.ReplicaSet{}, false, nil
+	} else if err != nil {
+		return serverpb.ReplicaSet{}, false, err
+	}
+	return set, true, nil
+}
+
+// loadReplicaBytes totals the size of the replicas held for other nodes.
+func (s *Server) loadReplicaBytes() error {
+	sets, err := s.replicaSets()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, set := range sets {
+		if set.Held {
+			total += set.Size
+		}
+	}
+	s.mu.Lock()
+	s.mu.replicaBytes = total
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) saveReplicaSet(documentID string, set serverpb.ReplicaSet) error {
+	b, err := set.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(replicasPrefix+documentID), b)
+	})
+}
+
+// repairReplicas periodically re-replicates documents whose holders are no
+// longer connected.
+func (s *Server) repairReplicas() {
+	for {
+		select {
+		case <-time.After(RepairInterval):
+		case <-s.ctx.Done():
+			return
+		}
+
+		if err := s.repairReplicasOnce(); err != nil {
+			s.log.Printf("repair replicas error: %+v", err)
+		}
+	}
+}
+
+// replicaSets returns the replica sets of every document this node maintains.
+func (s *Server) replicaSets() (map[string]serverpb.ReplicaSet, error) {
+	sets := map[string]serverpb.ReplicaSet{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(replicasPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var set serverpb.ReplicaSet
+			if err := set.Unmarshal(v); err != nil {
+				return err
+			}
+			sets[strings.TrimPrefix(string(it.Item().Key()), replicasPrefix)] = set
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return sets, nil
+}
+
+// repairReplicasOnce re-replicates documents that have fewer live holders than
+// wanted. Every holder does this, so documents survive the loss of the node
+// that added them.
+func (s *Server) repairReplicasOnce() error {
+	localID, err := s.getLocalId()
+	if err != nil {
+		return err
+	}
+	sets, err := s.replicaSets()
+	if err != nil {
+		return err
+	}
+
+	for documentID, set := range sets {
+		if err := s.repairReplica(localID, documentID, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairReplica re-replicates the document if it has fewer live holders than
+// wanted and this node is the live holder with the lowest ID. Every live
+// holder notices the loss, so electing one keeps them from all pushing extra
+// replicas.
+func (s *Server) repairReplica(localID, documentID string, set serverpb.ReplicaSet) error {
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+
+	alive, err := s.liveHolders(ctx, localID, documentID, set.Holders)
+	if err != nil {
+		return err
+	}
+	if len(alive) > int(set.Replication) {
+		return nil
+	}
+
+	var body []byte
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(fmt.Sprintf("/document/%s", documentID)))
+		if err != nil {
+			return err
+		}
+		body, err = item.Value()
+		return err
+	}); err == badger.ErrKeyNotFound {
+		// The document was deleted, stop maintaining it.
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(replicasPrefix + documentID))
+		}); err != nil {
+			return err
+		}
+		if set.Held {
+			s.releaseReplicaBytes(set.Size)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if alive[0] != localID {
+		return nil
+	}
+
+	holders := s.pushReplicas(ctx, documentID, body, set.Replication, alive)
+
+	s.log.Printf("repaired replicas of %s: %d of %d peers", documentID, len(holders)-1, set.Replication)
+	set.Holders = holders
+	return s.saveReplicaSet(documentID, set)
+}
+
+// liveHolders returns this node and the holders that are either connected
+// peers or listed by the router as providers of the document, sorted by ID.
+// Holders further away than a direct peer are only known through the router.
+func (s *Server) liveHolders(ctx context.Context, localID, documentID string, holders []string) ([]string, error) {
+	routes, err := s.router.FindProviders(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+	providers := map[string]bool{}
+	for _, route := range routes {
+		providers[route.ID] = true
+	}
+
+	alive := []string{localID}
+	s.mu.Lock()
+	for _, id := range holders {
+		if id == localID {
+			continue
+		}
+		if _, ok := s.mu.peers[id]; ok || providers[id] {
+			alive = append(alive, id)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Strings(alive)
+	return alive, nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+)
+
+func TestReplicaQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path:         dir,
+		ReplicaQuota: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	replicate := func(b byte, holders ...string) error {
+		body := bytes.Repeat([]byte{b}, 60)
+		_, err := s.Replicate(ctx, &serverpb.ReplicateRequest{
+			DocumentId:  HashBytes(body),
+			Body:        body,
+			Replication: 1,
+			Holders:     holders,
+		})
+		return err
+	}
+
+	if err := replicate('a', "x"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := replicate('b', "x"); errors.Cause(err) != ErrReplicaQuota {
+		t.Fatalf("expected quota to be exceeded; got %+v", err)
+	}
+	// Documents already held don't count twice.
+	if err := replicate('a', "y"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	set, ok, err := s.loadReplicaSet(HashBytes(bytes.Repeat([]byte{'a'}, 60)))
+	if err != nil || !ok {
+		t.Fatalf("expected replica set; got %v %+v", ok, err)
+	}
+	if len(set.Holders) != 3 {
+		t.Errorf("expected this node, x and y to hold it; got %v", set.Holders)
+	}
+
+	// The quota survives a restart.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(serverpb.NodeConfig{
+		Path:         dir,
+		ReplicaQuota: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := replicate('b', "x"); errors.Cause(err) != ErrReplicaQuota {
+		t.Errorf("expected quota to be exceeded after restart; got %+v", err)
+	}
+}
+
+func TestRepairReplicaElection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	localID, err := s.getLocalId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("replica")
+	documentID := HashBytes(body)
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fmt.Sprintf("/document/%s", documentID)), body)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Node IDs are hex, so "0" sorts before and "z" after this node.
+	for _, id := range []string{"0", "z"} {
+		s.mu.Lock()
+		s.mu.peers = map[string]*peer{id: {}}
+		s.mu.Unlock()
+
+		set := serverpb.ReplicaSet{
+			Replication: 2,
+			Holders:     []string{localID, id, "dead"},
+		}
+		if err := s.repairReplica(localID, documentID, set); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		_, repaired, err := s.loadReplicaSet(documentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wanted := id > localID; repaired != wanted {
+			t.Errorf("with live holder %s: repaired = %t; wanted %t", id, repaired, wanted)
+		}
+	}
+
+	s.mu.Lock()
+	s.mu.peers = map[string]*peer{}
+	s.mu.Unlock()
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrRequestLoop and ErrDuplicateRequest are gRPC status errors so the
+// forwarding node can tell them apart by code. They're returned unwrapped
+// since wrapping hides the code from gRPC.
+var (
+	ErrRequestLoop      = status.Error(codes.Aborted, "request looped back to this node")
+	ErrDuplicateRequest = status.Error(codes.AlreadyExists, "request is already being forwarded by this node")
+)
+
+// seenRequestTTL is how long a successfully forwarded request ID is
+// remembered.
+const seenRequestTTL = 30 * time.Second
+
+// forwarded is a request that this node is about to forward to its peers.
+type forwarded struct {
+	id      string
+	visited []string
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// forwardRequest checks that the request hasn't already passed through or
+// isn't already being forwarded by this node, and records that it is. Requests
+// without an ID are given one. The request must be forgotten with
+// forgetRequest if forwarding fails, so retries along other routes can pass
+// through this node again.
+func (s *Server) forwardRequest(id string, visited []string) (forwarded, error) {
+	localID, err := s.getLocalId()
+	if err != nil {
+		return forwarded{}, err
+	}
+	for _, v := range visited {
+		if v == localID {
+			return forwarded{}, ErrRequestLoop
+		}
+	}
+	if id == "" {
+		id, err = newRequestID()
+		if err != nil {
+			return forwarded{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.mu.seenRequestsPruned) > seenRequestTTL {
+		for k, expires := range s.mu.seenRequests {
+			if now.After(expires) {
+				delete(s.mu.seenRequests, k)
+			}
+		}
+		s.mu.seenRequestsPruned = now
+	}
+	if expires, ok := s.mu.seenRequests[id]; ok && now.Before(expires) {
+		return forwarded{}, ErrDuplicateRequest
+	}
+	s.mu.seenRequests[id] = now.Add(seenRequestTTL)
+
+	return forwarded{
+		id:      id,
+		visited: append(append([]string{}, visited...), localID),
+	}, nil
+}
+
+// forgetRequest removes the request ID from the seen requests.
+func (s *Server) forgetRequest(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.mu.seenRequests, id)
+}
+
+// remainingHops returns the hop budget to send along with a request forwarded
+// over route. A budget of -1 means the request started here and the route's
+// distance is used. Either way the hop to the peer is spent, so the peer only
+// searches the hops that are left, the same as LocateProvider always has. The
+// budget reaching 0 then bounds how far a request travels.
+func remainingHops(numHops int32, route Route) int32 {
+	if numHops == -1 {
+		numHops = route.NumHops
+	}
+	return numHops - 1
+}
+
+// filter removes routes through nodes the request has already visited.
+func (f forwarded) filter(routes []Route) []Route {
+	var out []Route
+	for _, route := range routes {
+		if !f.visitedNode(route.ID) {
+			out = append(out, route)
+		}
+	}
+	return out
+}
+
+func (f forwarded) visitedNode(id string) bool {
+	for _, v := range f.visited {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// isDroppedRequest returns whether a peer dropped the request as a loop or
+// duplicate. Those aren't failures of the peer.
+func isDroppedRequest(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.AlreadyExists:
+		return true
+	}
+	return false
+}
+
+// isTooLarge returns whether the error is a node refusing to send a document
+// larger than the request's max size.
+func isTooLarge(err error) bool {
+	return status.Code(errors.Cause(err)) == codes.ResourceExhausted
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForwardRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(serverpb.NodeConfig{
+		Path: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	localID, err := s.getLocalId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fwd, err := s.forwardRequest("", []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd.id == "" {
+		t.Fatal("expected a request ID to be generated")
+	}
+	if len(fwd.visited) != 2 || fwd.visited[1] != localID {
+		t.Fatalf("expected local node to be visited; got %+v", fwd.visited)
+	}
+
+	routes := fwd.filter([]Route{{ID: "a"}, {ID: "b"}, {ID: localID}})
+	if len(routes) != 1 || routes[0].ID != "b" {
+		t.Fatalf("expected only unvisited routes; got %+v", routes)
+	}
+
+	if _, err := s.forwardRequest(fwd.id, nil); err != ErrDuplicateRequest {
+		t.Fatalf("expected ErrDuplicateRequest; got %+v", err)
+	}
+	if _, err := s.forwardRequest("other", fwd.visited); err != ErrRequestLoop {
+		t.Fatalf("expected ErrRequestLoop; got %+v", err)
+	}
+
+	// Forgotten requests can be forwarded again.
+	s.forgetRequest(fwd.id)
+	if _, err := s.forwardRequest(fwd.id, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		numHops, routeHops, want int32
+	}{
+		{-1, 1, 0},
+		{-1, 3, 2},
+		{2, 3, 1},
+		{1, 1, 0},
+	} {
+		if got := remainingHops(c.numHops, Route{NumHops: c.routeHops}); got != c.want {
+			t.Errorf("remainingHops(%d, %d) = %d; want %d", c.numHops, c.routeHops, got, c.want)
+		}
+	}
+
+	// Errors from peers arrive as new status errors with the same code.
+	if !isDroppedRequest(status.Error(codes.AlreadyExists, "duplicate")) {
+		t.Error("expected remote duplicate error to be detected")
+	}
+	if isDroppedRequest(errors.Errorf("%s", ErrDuplicateRequest)) {
+		t.Error("expected other errors not to be detected")
+	}
+}
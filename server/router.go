@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RouterBloom routes using hop indexed bloom filters exchanged with peers.
+	RouterBloom = "bloom"
+	// RouterKademlia routes using a Kademlia style DHT of provider records.
+	RouterKademlia = "kademlia"
+)
+
+// Router finds which nodes can provide documents and references.
+type Router interface {
+	// Provide announces that the local node holds id.
+	Provide(ctx context.Context, id string) error
+	// FindProviders returns routes to nodes that claim to hold id, best first.
+	FindProviders(ctx context.Context, id string) ([]Route, error)
+	// Run maintains the router in the background until the server is closed.
+	Run()
+}
+
+func newRouter(s *Server, name string) (Router, error) {
+	switch name {
+	case "", RouterBloom:
+		return &bloomRouter{s: s}, nil
+	case RouterKademlia:
+		return newDHTRouter(s), nil
+	default:
+		return nil, errors.Errorf("config: unknown router %q", name)
+	}
+}
+
+// bloomRouter routes using the bloom filter routing tables.
+type bloomRouter struct {
+	s *Server
+}
+
+func (r *bloomRouter) Provide(ctx context.Context, id string) error {
+	return r.s.addToRoutingTable(id)
+}
+
+func (r *bloomRouter) FindProviders(ctx context.Context, id string) ([]Route, error) {
+	return r.s.peersWithFile(id), nil
+}
+
+func (r *bloomRouter) Run() {
+	r.s.ReceiveNewRoutingTable()
+}
+
+// FindProviders returns the nodes that claim to hold a document or reference,
+// nearest first.
+func (s *Server) FindProviders(ctx context.Context, req *serverpb.FindProvidersRequest) (*serverpb.FindProvidersResponse, error) {
+	id := req.GetId()
+	// Accept access IDs so they can be pasted straight from add.
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[:i]
+	}
+	if id == "" {
+		return nil, errors.Errorf("missing id")
+	}
+
+	resp := &serverpb.FindProvidersResponse{}
+
+	local, err := s.hasLocal(id)
+	if err != nil {
+		return nil, err
+	}
+	if local {
+		meta, err := s.NodeMeta()
+		if err != nil {
+			return nil, err
+		}
+		resp.Providers = append(resp.Providers, &serverpb.Provider{
+			Id:    meta.Id,
+			Addrs: meta.Addrs,
+		})
+	}
+
+	routes, err := s.router.FindProviders(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		resp.Providers = append(resp.Providers, &serverpb.Provider{
+			Id:      route.ID,
+			Addrs:   route.Addrs,
+			NumHops: route.NumHops,
+		})
+	}
+	return resp, nil
+}
+
+// hasLocal returns whether the document or reference is stored locally.
+func (s *Server) hasLocal(id string) (bool, error) {
+	found := false
+	if err := s.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range []string{"/document/", "/reference/"} {
+			_, err := txn.Get([]byte(fmt.Sprintf("%s%s", prefix, id)))
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			found = true
+			return nil
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return found, nil
+}
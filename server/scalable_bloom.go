@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/willf/bloom"
+)
+
+const (
+	// minFilterKeys is the capacity of the smallest filter slice.
+	minFilterKeys = 1024
+	// filterGrowth is how much larger each new filter slice is than the last.
+	filterGrowth = 2
+	// filterTightening is how much lower each new filter slice's false
+	// positive probability is than the last.
+	filterTightening = 0.5
+
+	// filterVersion is the version of the BloomFilterSlice encoding.
+	filterVersion = 1
+	// filterHashScheme is how willf/bloom derives bit locations from keys.
+	filterHashScheme = "murmur3-128"
+	// maxFilterK is the most hash functions a received slice may use. Testing
+	// a key costs k lookups per slice, so this bounds the work a peer can cause.
+	maxFilterK = 64
+)
+
+// filterSlice is a fixed size bloom filter along with the number of keys
+// added to it and the number it was sized for. The filter is built with
+// bloom.From over words so the bits can be encoded without relying on
+// willf/bloom's own encoding.
+type filterSlice struct {
+	filter   *bloom.BloomFilter
+	words    []uint64
+	count    uint64
+	capacity uint64
+}
+
+// scalableFilter is a scalable bloom filter. Keys are added to the newest
+// slice and once it reaches capacity a larger slice is started. The slices'
+// false positive probabilities form a geometric series that sums to
+// FalsePositiveProbability, so the filter's rate stays under it no matter how
+// many keys a node holds.
+type scalableFilter struct {
+	slices []*filterSlice
+}
+
+// newFilterSlice returns an empty slice sized for capacity keys to be the
+// index'th slice of a filter.
+func newFilterSlice(capacity uint64, index int) *filterSlice {
+	if capacity < minFilterKeys {
+		capacity = minFilterKeys
+	}
+	p := FalsePositiveProbability * (1 - filterTightening) * math.Pow(filterTightening, float64(index))
+	m, k := bloom.EstimateParameters(uint(capacity), p)
+	s := newFilterSliceFrom(make([]uint64, (m+63)/64), k)
+	s.capacity = capacity
+	return s
+}
+
+// newFilterSliceFrom returns a slice backed by words. m is rounded up to a
+// whole number of words since that's what bloom.From uses.
+func newFilterSliceFrom(words []uint64, k uint) *filterSlice {
+	return &filterSlice{
+		filter: bloom.From(words, k),
+		words:  words,
+	}
+}
+
+// newScalableFilter returns an empty filter sized for the expected number of
+// keys.
+func newScalableFilter(keys uint64) *scalableFilter {
+	return &scalableFilter{
+		slices: []*filterSlice{newFilterSlice(keys, 0)},
+	}
+}
+
+func decodeFilter(bf *serverpb.BloomFilter) (*scalableFilter, error) {
+	f := &scalableFilter{}
+	for _, s := range bf.GetSlices() {
+		slice, err := decodeSlice(s)
+		if err != nil {
+			return nil, err
+		}
+		f.slices = append(f.slices, slice)
+	}
+	return f, nil
+}
+
+// encode returns the portable encoding of the filter. Slices are written in
+// order of capacity and then bits, so filters holding the same slices encode
+// the same however they were merged. A node's own slices grow in capacity, so
+// its newest slice stays last.
+func (f *scalableFilter) encode() (*serverpb.BloomFilter, error) {
+	slices := append([]*filterSlice(nil), f.slices...)
+	sort.SliceStable(slices, func(i, j int) bool {
+		a, b := slices[i], slices[j]
+		if a.capacity != b.capacity {
+			return a.capacity < b.capacity
+		}
+		return lessWords(a.words, b.words)
+	})
+
+	bf := &serverpb.BloomFilter{}
+	for _, s := range slices {
+		bf.Slices = append(bf.Slices, encodeSlice(s))
+	}
+	return bf, nil
+}
+
+func lessWords(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// encodeSlice translates a filter slice into the portable encoding. The words
+// are written least significant byte first.
+func encodeSlice(s *filterSlice) *serverpb.BloomFilterSlice {
+	bits := make([]byte, len(s.words)*8)
+	for i, word := range s.words {
+		binary.LittleEndian.PutUint64(bits[i*8:], word)
+	}
+	return &serverpb.BloomFilterSlice{
+		Version:    filterVersion,
+		HashScheme: filterHashScheme,
+		M:          uint64(len(s.words)) * 64,
+		K:          uint64(s.filter.K()),
+		Bits:       bits,
+		Count:      s.count,
+		Capacity:   s.capacity,
+	}
+}
+
+// decodeSlice translates a portably encoded filter slice back into a filter.
+func decodeSlice(s *serverpb.BloomFilterSlice) (*filterSlice, error) {
+	if s.Version != filterVersion {
+		return nil, errors.Errorf("unsupported filter version %d", s.Version)
+	}
+	if s.HashScheme != filterHashScheme {
+		return nil, errors.Errorf("unsupported filter hash scheme %q", s.HashScheme)
+	}
+	if s.M == 0 || s.K == 0 {
+		return nil, errors.Errorf("filter must have m and k set")
+	}
+	if s.K > maxFilterK {
+		return nil, errors.Errorf("filter has k %d, at most %d is allowed", s.K, maxFilterK)
+	}
+	if s.M%64 != 0 {
+		return nil, errors.Errorf("filter m %d isn't a whole number of words", s.M)
+	}
+	if uint64(len(s.Bits)) != s.M/8 {
+		return nil, errors.Errorf("filter has %d bytes of bits, expected %d", len(s.Bits), s.M/8)
+	}
+
+	words := make([]uint64, s.M/64)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(s.Bits[i*8:])
+	}
+	slice := newFilterSliceFrom(words, uint(s.K))
+	slice.count = s.Count
+	slice.capacity = s.Capacity
+	return slice, nil
+}
+
+func (f *scalableFilter) AddString(key string) {
+	if len(f.slices) == 0 {
+		f.slices = append(f.slices, newFilterSlice(0, 0))
+	}
+	last := f.slices[len(f.slices)-1]
+	if last.count >= last.capacity {
+		last = newFilterSlice(last.capacity*filterGrowth, len(f.slices))
+		f.slices = append(f.slices, last)
+	}
+	last.filter.AddString(key)
+	last.count++
+}
+
+func (f *scalableFilter) TestString(key string) bool {
+	for _, s := range f.slices {
+		if s.filter.TestString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge adds all keys in o to f. Slices of the same size are combined if the
+// result is within capacity, otherwise they're kept separately.
+func (f *scalableFilter) Merge(o *scalableFilter) error {
+	for _, os := range o.slices {
+		merged := false
+		for _, s := range f.slices {
+			if s.capacity != os.capacity || s.filter.Cap() != os.filter.Cap() || s.filter.K() != os.filter.K() {
+				continue
+			}
+			if s.filter.Equal(os.filter) {
+				merged = true
+				break
+			}
+			if s.count+os.count > s.capacity {
+				continue
+			}
+			// Union the words directly so they keep backing s.filter.
+			for i, word := range os.words {
+				s.words[i] |= word
+			}
+			s.count += os.count
+			merged = true
+			break
+		}
+		if !merged {
+			s := newFilterSliceFrom(append([]uint64(nil), os.words...), os.filter.K())
+			s.count = os.count
+			s.capacity = os.capacity
+			f.slices = append(f.slices, s)
+		}
+	}
+	return nil
+}
+
+// Count returns the number of keys added to the filter. Merged filters may
+// count keys more than once.
+func (f *scalableFilter) Count() uint64 {
+	var n uint64
+	for _, s := range f.slices {
+		n += s.count
+	}
+	return n
+}
+
+// Bits returns the total size of the filter in bits.
+func (f *scalableFilter) Bits() uint64 {
+	var n uint64
+	for _, s := range f.slices {
+		n += uint64(s.filter.Cap())
+	}
+	return n
+}
+
+// FalsePositiveRate estimates the probability that a key that hasn't been
+// added tests positive.
+func (f *scalableFilter) FalsePositiveRate() float64 {
+	miss := 1.0
+	for _, s := range f.slices {
+		m := float64(s.filter.Cap())
+		k := float64(s.filter.K())
+		n := float64(s.count)
+		miss *= 1 - math.Pow(1-math.Exp(-k*n/m), k)
+	}
+	return 1 - miss
+}
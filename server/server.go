@@ -13,6 +13,7 @@ import (
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/fatih/color"
@@ -40,6 +41,8 @@ type Server struct {
 	cancel context.CancelFunc
 	mux    *http.ServeMux
 
+	router Router
+
 	mu struct {
 		sync.Mutex
 
@@ -56,6 +59,32 @@ type Server struct {
 		nextListenerID int
 
 		routingTable serverpb.RoutingTable
+		// routingTableStale is set when the local filter contains deleted
+		// documents and needs to be rebuilt.
+		routingTableStale      bool
+		rebuildingRoutingTable bool
+		rebuildAdds            []string
+
+		// seenRequests maps forwarded request IDs to when they expire.
+		seenRequests       map[string]time.Time
+		seenRequestsPruned time.Time
+
+		// flights are the in progress fetches shared by concurrent callers.
+		flights map[string]*flight
+		// notFound maps recently failed lookups to when they expire.
+		notFound map[string]time.Time
+		// prefetching is the set of directories being prefetched.
+		prefetching map[string]struct{}
+		// redial tracks backoff for reconnecting to known peers.
+		redial map[string]*redialState
+		// scores tracks how much valid and invalid data each peer has sent.
+		scores map[string]int
+		// bans maps banned node IDs to when the ban ends.
+		bans map[string]time.Time
+		// blocklist is the operator managed blocklist, keyed by blocklistKey.
+		blocklist map[string]serverpb.BlocklistEntry
+		// replicaBytes is the size of the replicas held for other nodes.
+		replicaBytes int64
 
 		closed bool
 	}
@@ -75,6 +104,14 @@ func New(c serverpb.NodeConfig) (*Server, error) {
 	s.mu.peers = map[string]*peer{}
 	s.mu.channels = map[string]*channel{}
 	s.mu.connecting = map[string]struct{}{}
+	s.mu.seenRequests = map[string]time.Time{}
+	s.mu.flights = map[string]*flight{}
+	s.mu.notFound = map[string]time.Time{}
+	s.mu.prefetching = map[string]struct{}{}
+	s.mu.redial = map[string]*redialState{}
+	s.mu.scores = map[string]int{}
+	s.mu.bans = map[string]time.Time{}
+	s.mu.blocklist = map[string]serverpb.BlocklistEntry{}
 
 	if len(c.Path) == 0 {
 		return nil, errors.Errorf("config: path must not be empty")
@@ -97,12 +134,26 @@ func New(c serverpb.NodeConfig) (*Server, error) {
 	if err := s.loadOrGenerateCert(); err != nil {
 		return nil, err
 	}
+	if err := s.loadNodeMeta(); err != nil {
+		return nil, err
+	}
+	if err := s.loadBlocklist(); err != nil {
+		return nil, err
+	}
+	if err := s.loadReplicaBytes(); err != nil {
+		return nil, err
+	}
 
 	s.setupHTTP()
 	if err := s.loadRoutingTable(); err != nil {
 		return nil, err
 	}
 
+	s.router, err = newRouter(s, c.Router)
+	if err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
@@ -164,24 +215,36 @@ func (s *Server) Listen(addr string) error {
 	grpcServer := grpc.NewServer(
 		grpc.MaxRecvMsgSize(int(config.GRPCMsgSize)),
 		grpc.MaxSendMsgSize(int(config.GRPCMsgSize)),
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
 	)
 	serverpb.RegisterNodeServer(grpcServer, s)
 	serverpb.RegisterClientServer(grpcServer, s)
-	go s.ReceiveNewRoutingTable()
+	go s.router.Run()
+	go s.repairReplicas()
+	go s.reconnectPeers()
+	go s.gossipSelf()
+	if len(s.config.DiscoveryAddr) > 0 {
+		go s.discover()
+	}
 
+	web := s.swarmHTTP(s.mux)
 	httpServer := http.Server{
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.ProtoMajor == 2 && strings.HasPrefix(
 				r.Header.Get("Content-Type"), "application/grpc") {
 				grpcServer.ServeHTTP(w, r)
 			} else {
-				s.mux.ServeHTTP(w, r)
+				web.ServeHTTP(w, r)
 			}
 		}),
 		TLSConfig: &tls.Config{
 			Certificates: []tls.Certificate{
 				*s.cert,
 			},
+			// Nodes authenticate with their certificate, which is checked
+			// against their ID per RPC. Browsers and clients don't have one.
+			ClientAuth: tls.RequestClientCert,
 		},
 	}
 
@@ -208,7 +271,7 @@ func (s *Server) Listen(addr string) error {
 	})
 
 	mux := runtime.NewServeMux()
-	s.mux.Handle("/api/", http.StripPrefix("/api", mux))
+	s.mux.Handle("/api/", http.StripPrefix("/api", localOnlyGateway(mux)))
 	s.mux.Handle("/source/", http.StripPrefix("/source/", http.FileServer(http.Dir("."))))
 
 	conn, err := s.LocalConn()
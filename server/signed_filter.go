@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/base64"
+	"math"
+	"math/bits"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFilterFalsePositive is the largest false positive rate a received
+	// filter may have across all its slices. A node's own filter is around
+	// FalsePositiveProbability and filters of further hops merge many nodes'
+	// filters, so anything above this matches far too many keys to be useful.
+	maxFilterFalsePositive = 0.5
+	// maxFilterSlices is the most slices a received filter may have.
+	maxFilterSlices = 256
+)
+
+func filterHash(bf *serverpb.BloomFilter) ([]byte, error) {
+	unsigned := *bf
+	unsigned.Signature = ""
+	body, err := unsigned.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(body)
+	return hash[:], nil
+}
+
+// signFilter signs a node's own level 0 filter.
+func signFilter(bf *serverpb.BloomFilter, key *ecdsa.PrivateKey) error {
+	hash, err := filterHash(bf)
+	if err != nil {
+		return err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return err
+	}
+	sig, err := asn1.Marshal(EcdsaSignature{R: r, S: s})
+	if err != nil {
+		return err
+	}
+	bf.Signature = base64.URLEncoding.EncodeToString(sig)
+	return nil
+}
+
+// verifyFilter checks that the filter was signed by the node.
+func verifyFilter(bf *serverpb.BloomFilter, meta serverpb.NodeMeta) error {
+	if bf.Signature == "" {
+		return errors.Errorf("filter from %s is unsigned", meta.Id)
+	}
+	publicKey, err := nodeMetaPublicKey(meta)
+	if err != nil {
+		return err
+	}
+	rawSig, err := base64.URLEncoding.DecodeString(bf.Signature)
+	if err != nil {
+		return err
+	}
+	var sig EcdsaSignature
+	if _, err := asn1.Unmarshal(rawSig, &sig); err != nil {
+		return err
+	}
+	hash, err := filterHash(bf)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.Verify(publicKey, hash, sig.R, sig.S) {
+		return errors.Errorf("filter from %s has an invalid signature", meta.Id)
+	}
+	return nil
+}
+
+// filterFalsePositiveRate returns the probability that a key that hasn't
+// been added tests positive against any slice of the filter. It counts the set
+// bits directly since the slice counts are reported by the sender and can't be
+// trusted.
+func filterFalsePositiveRate(bf *serverpb.BloomFilter) (float64, error) {
+	if len(bf.GetSlices()) > maxFilterSlices {
+		return 0, errors.Errorf("filter has %d slices, at most %d are allowed", len(bf.GetSlices()), maxFilterSlices)
+	}
+	miss := 1.0
+	for _, slice := range bf.GetSlices() {
+		if slice.M == 0 || slice.K == 0 {
+			return 0, errors.Errorf("filter slice must have m and k set")
+		}
+		if slice.M%64 != 0 {
+			return 0, errors.Errorf("filter slice m %d isn't a whole number of words", slice.M)
+		}
+		if uint64(len(slice.Bits)) != slice.M/8 {
+			return 0, errors.Errorf("filter slice has %d bytes of bits, expected %d", len(slice.Bits), slice.M/8)
+		}
+		ones := 0
+		for _, b := range slice.Bits {
+			ones += bits.OnesCount8(b)
+		}
+		fill := float64(ones) / float64(slice.M)
+		miss *= 1 - math.Pow(fill, float64(slice.K))
+	}
+	return 1 - miss, nil
+}
+
+// checkRoutingTable validates a routing table received from the peer. The
+// peer's own filter must be signed by it and no filter may be over-saturated.
+func checkRoutingTable(rt *serverpb.RoutingTable, meta serverpb.NodeMeta) error {
+	if len(rt.Filters) > 0 {
+		if err := verifyFilter(rt.Filters[0], meta); err != nil {
+			return err
+		}
+	}
+	for i, bf := range rt.Filters {
+		rate, err := filterFalsePositiveRate(bf)
+		if err != nil {
+			return errors.Wrapf(err, "filter at %d hops from %s", i, meta.Id)
+		}
+		if rate > maxFilterFalsePositive {
+			return errors.Errorf("filter at %d hops from %s is over-saturated: %.2f false positive rate", i, meta.Id, rate)
+		}
+	}
+	return nil
+}
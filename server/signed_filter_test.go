@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/bits"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+)
+
+func TestSignedFilter(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := serverpb.NodeMeta{PublicKey: string(publicKey)}
+
+	bf := filter(t, "a", "b")
+	if err := verifyFilter(bf, meta); err == nil {
+		t.Fatal("expected unsigned filter to fail verification")
+	}
+	if err := signFilter(bf, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFilter(bf, meta); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	tampered := *bf
+	tampered.Slices = filter(t, "a", "b", "c").Slices
+	if err := verifyFilter(&tampered, meta); err == nil {
+		t.Fatal("expected tampered filter to fail verification")
+	}
+}
+
+func TestFilterFalsePositiveRate(t *testing.T) {
+	if rate, err := filterFalsePositiveRate(filter(t, "a")); err != nil {
+		t.Fatal(err)
+	} else if rate > maxFilterFalsePositive {
+		t.Fatalf("sparse filter reported as over-saturated: %f", rate)
+	}
+
+	// Add far more keys than the slice was sized for without growing it.
+	f := newScalableFilter(0)
+	for i := 0; i < 20*minFilterKeys; i++ {
+		f.slices[0].filter.AddString(fmt.Sprintf("%d", i))
+	}
+	bf, err := f.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate, err := filterFalsePositiveRate(bf); err != nil {
+		t.Fatal(err)
+	} else if rate <= maxFilterFalsePositive {
+		t.Fatalf("saturated filter not detected: %f", rate)
+	}
+
+	// Many slices that are each well under saturated still match most keys
+	// together.
+	f = &scalableFilter{}
+	for i := 0; i < maxFilterSlices; i++ {
+		s := newFilterSlice(minFilterKeys, 0)
+		for j := uint64(0); j < s.capacity*3/2; j++ {
+			s.filter.AddString(fmt.Sprintf("%d-%d", i, j))
+		}
+		f.slices = append(f.slices, s)
+	}
+	bf, err = f.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fill := filterFill(bf.Slices[0]); fill > 0.75 {
+		t.Fatalf("expected slices to be under 75%% full; got %f", fill)
+	}
+	if rate, err := filterFalsePositiveRate(bf); err != nil {
+		t.Fatal(err)
+	} else if rate <= maxFilterFalsePositive {
+		t.Fatalf("filter with many partly full slices not detected: %f", rate)
+	}
+
+	bf.Slices = append(bf.Slices, bf.Slices[0])
+	if _, err := filterFalsePositiveRate(bf); err == nil {
+		t.Fatal("expected filter with too many slices to be rejected")
+	}
+}
+
+// filterFill returns the fraction of set bits in the slice.
+func filterFill(slice *serverpb.BloomFilterSlice) float64 {
+	ones := 0
+	for _, b := range slice.Bits {
+		ones += bits.OnesCount8(b)
+	}
+	return float64(ones) / float64(slice.M)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var ErrSwarmKey = errors.New("peer doesn't hold the swarm key")
+
+const (
+	// swarmProofHeader is the metadata key peers prove they hold the swarm key
+	// with on every Node RPC.
+	swarmProofHeader = "swarm-proof"
+
+	helloProofLabel = "hello"
+	rpcProofLabel   = "rpc"
+)
+
+// swarmProof is an HMAC of the label and IDs with the swarm key. It proves the
+// sender holds the key without revealing it.
+func swarmProof(key, label string, ids ...string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(label))
+	for _, id := range ids {
+		mac.Write([]byte{0})
+		mac.Write([]byte(id))
+	}
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// helloProof returns the proof sent in a Hello from one node to another. It's
+// bound to both IDs so it can't be replayed to or from other nodes. It's empty
+// if the node isn't part of a private network.
+func (s *Server) helloProof(from, to string) string {
+	if s.config.SwarmKey == "" {
+		return ""
+	}
+	return swarmProof(s.config.SwarmKey, helloProofLabel, from, to)
+}
+
+// checkHelloProof verifies a Hello proof from another node.
+func (s *Server) checkHelloProof(proof, from, to string) error {
+	if s.config.SwarmKey == "" {
+		return nil
+	}
+	if !hmac.Equal([]byte(proof), []byte(s.helloProof(from, to))) {
+		return errors.Wrapf(ErrSwarmKey, "node %s", from)
+	}
+	return nil
+}
+
+// isSwarmExempt returns whether the Node RPC can be made without a swarm
+// proof. Hello checks its own proof and Meta stays open so nodes can be
+// bootstrapped.
+func isSwarmExempt(method string) bool {
+	return method == "/serverpb.Node/Hello" || method == "/serverpb.Node/Meta"
+}
+
+// rpcProof is the proof a node attaches to its Node RPCs. It's bound to the
+// caller's ID, which the callee checks against the client certificate, so a
+// node that receives it can't replay it as its own.
+func (s *Server) rpcProof(callerID string) string {
+	return swarmProof(s.config.SwarmKey, rpcProofLabel, callerID)
+}
+
+// swarmDialOptions returns the dial options needed to call nodes in the
+// private network, if there is one. The proof isn't attached to Hello or
+// Meta, which may be sent to nodes outside the network.
+func (s *Server) swarmDialOptions() ([]grpc.DialOption, error) {
+	if s.config.SwarmKey == "" {
+		return nil, nil
+	}
+	localID, err := s.getLocalId()
+	if err != nil {
+		return nil, err
+	}
+	proof := s.rpcProof(localID)
+	withProof := func(ctx context.Context, method string) context.Context {
+		if isSwarmExempt(method) {
+			return ctx
+		}
+		return metadata.AppendToOutgoingContext(ctx, swarmProofHeader, proof)
+	}
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(withProof(ctx, method), method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(withProof(ctx, method), desc, cc, method, opts...)
+		}),
+	}, nil
+}
+
+// checkSwarmRPC refuses Node RPCs from nodes outside the private network.
+// callerID is the ID from the caller's client certificate.
+func (s *Server) checkSwarmRPC(ctx context.Context, method, callerID string) error {
+	if s.config.SwarmKey == "" || !isNodeRPC(method) || isSwarmExempt(method) {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	want := s.rpcProof(callerID)
+	for _, proof := range md[swarmProofHeader] {
+		if hmac.Equal([]byte(proof), []byte(want)) {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrSwarmKey, "node %s calling %s", callerID, method)
+}
+
+// checkSwarmClientRPC restricts Client RPCs to local callers in a private
+// network. Clients have no way to prove they hold the swarm key, so otherwise
+// anyone could read the network's content through any node.
+func (s *Server) checkSwarmClientRPC(ctx context.Context, method string) error {
+	if s.config.SwarmKey == "" || !isClientRPC(method) {
+		return nil
+	}
+	return requireLocalCaller(ctx)
+}
+
+// swarmHTTP refuses HTTP requests from other machines in a private network.
+// The web interface and gateway make Client RPCs through a connection to the
+// node itself, so they'd otherwise get around checkSwarmClientRPC.
+func (s *Server) swarmHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.SwarmKey != "" && !isLocalAddr(r.RemoteAddr) {
+			http.Error(w, ErrNotLocal.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
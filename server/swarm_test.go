@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+)
+
+func TestSwarmProof(t *testing.T) {
+	a := &Server{config: serverpb.NodeConfig{SwarmKey: "a"}}
+	b := &Server{config: serverpb.NodeConfig{SwarmKey: "b"}}
+	open := &Server{}
+
+	if err := a.checkHelloProof(a.helloProof("x", "y"), "x", "y"); err != nil {
+		t.Errorf("expected proof to be accepted: %+v", err)
+	}
+	if err := a.checkHelloProof(a.helloProof("x", "y"), "y", "x"); err == nil {
+		t.Error("expected proof for other nodes to be refused")
+	}
+	if err := a.checkHelloProof(b.helloProof("x", "y"), "x", "y"); err == nil {
+		t.Error("expected proof with another key to be refused")
+	}
+	if err := a.checkHelloProof("", "x", "y"); err == nil {
+		t.Error("expected missing proof to be refused")
+	}
+	if err := open.checkHelloProof("", "x", "y"); err != nil {
+		t.Errorf("expected nodes without a key to accept anyone: %+v", err)
+	}
+
+	withProof := func(s *Server, id string) context.Context {
+		md := metadata.Pairs(swarmProofHeader, s.rpcProof(id))
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+	cases := []struct {
+		ctx    context.Context
+		method string
+		ok     bool
+	}{
+		{withProof(a, "x"), "/serverpb.Node/GetRoutingTable", true},
+		{withProof(b, "x"), "/serverpb.Node/GetRoutingTable", false},
+		// A proof received from x can't be replayed by y.
+		{withProof(a, "y"), "/serverpb.Node/GetRoutingTable", false},
+		{context.Background(), "/serverpb.Node/GetRoutingTable", false},
+		{context.Background(), "/serverpb.Node/Hello", true},
+		{context.Background(), "/serverpb.Node/Meta", true},
+		{context.Background(), "/serverpb.Client/Get", true},
+	}
+	for i, c := range cases {
+		if err := a.checkSwarmRPC(c.ctx, c.method, "x"); (err == nil) != c.ok {
+			t.Errorf("%d. checkSwarmRPC(%s) = %v; expected ok %t", i, c.method, err, c.ok)
+		}
+	}
+}
+
+func TestSwarmClientLocalOnly(t *testing.T) {
+	private := &Server{config: serverpb.NodeConfig{SwarmKey: "a"}}
+	open := &Server{}
+
+	from := func(ip net.IP) context.Context {
+		return grpcpeer.NewContext(context.Background(), &grpcpeer.Peer{
+			Addr: &net.TCPAddr{IP: ip, Port: 1234},
+		})
+	}
+	local := from(net.IPv4(127, 0, 0, 1))
+	remote := from(net.IPv4(203, 0, 113, 1))
+
+	type testCase struct {
+		s      *Server
+		ctx    context.Context
+		method string
+		ok     bool
+	}
+	cases := []testCase{
+		{private, local, "/serverpb.Client/Get", true},
+		{private, remote, "/serverpb.Client/Get", false},
+		{private, remote, "/serverpb.Client/FindProviders", false},
+		{private, context.Background(), "/serverpb.Client/GetStats", true},
+		// Node RPCs are covered by the swarm proof instead.
+		{private, remote, "/serverpb.Node/GetRemoteFile", true},
+		{open, remote, "/serverpb.Client/Get", true},
+	}
+	// The node calling itself on an interface address is local too.
+	ips, err := interfaceIPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) > 0 {
+		cases = append(cases, testCase{private, from(ips[0]), "/serverpb.Client/Get", true})
+	}
+	for i, c := range cases {
+		if err := c.s.checkSwarmClientRPC(c.ctx, c.method); (err == nil) != c.ok {
+			t.Errorf("%d. checkSwarmClientRPC(%s) = %v; expected ok %t", i, c.method, err, c.ok)
+		}
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for i, c := range []struct {
+		s          *Server
+		remoteAddr string
+		code       int
+	}{
+		{private, "127.0.0.1:1234", http.StatusOK},
+		{private, "[::1]:1234", http.StatusOK},
+		{private, "203.0.113.1:1234", http.StatusForbidden},
+		{open, "203.0.113.1:1234", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/file/x", nil)
+		r.RemoteAddr = c.remoteAddr
+		w := httptest.NewRecorder()
+		c.s.swarmHTTP(ok).ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%d. request from %s: got status %d; expected %d", i, c.remoteAddr, w.Code, c.code)
+		}
+	}
+}